@@ -1,26 +1,64 @@
 package main
 
 import (
+	"context"
 	"dns"
 	"dns/resolve"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 )
 
 func main() {
-	for _, name := range os.Args[1:] {
-		fmt.Printf("resolving %q\n", name)
-		host, err := dns.ParseName(name)
+	rootHints := flag.String("root-hints", "", "named.root file to load root servers from, instead of the built-in hints")
+	family := flag.String("family", "happy-eyeballs", "address family for contacting name servers: ipv4, ipv6 or happy-eyeballs")
+	resolvConf := flag.String("resolv-conf", "", "resolv.conf file to find recursive resolvers to ask in, instead of resolving from the root")
+	flag.Parse()
+
+	var stub *resolve.StubResolver
+	if *resolvConf != "" {
+		conf, err := resolve.LoadResolvConf(*resolvConf)
 		if err != nil {
-			log.Printf("skipping invalid name %q: %s\n", name, err)
-			continue
+			log.Fatalf("couldn't load resolv.conf: %s", err)
+		}
+		stub = resolve.NewStubResolver(conf)
+	}
+
+	resolver := resolve.NewResolver()
+	var err error
+	if resolver.Family, err = resolve.ParseAddressFamily(*family); err != nil {
+		log.Fatal(err)
+	}
+	if *rootHints != "" {
+		f, err := os.Open(*rootHints)
+		if err != nil {
+			log.Fatalf("couldn't open root hints: %s", err)
+		}
+		err = resolver.LoadRootHints(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("couldn't load root hints: %s", err)
 		}
-		rsp, err := resolve.Resolve(dns.Question{
-			Name:  host,
-			Type:  dns.A,
-			Class: dns.IN,
-		})
+	}
+
+	// options come after the flags, as in dig:
+	ctx := context.Background()
+	var names []string
+	for _, arg := range flag.Args() {
+		switch arg {
+		case "+trace":
+			ctx = resolve.WithTrace(ctx, func(event resolve.TraceEvent) {
+				fmt.Printf(";; %s\n", event)
+			})
+		default:
+			names = append(names, arg)
+		}
+	}
+
+	for _, name := range names {
+		fmt.Printf("resolving %q\n", name)
+		rsp, err := lookup(ctx, resolver, stub, name)
 		if err != nil {
 			log.Printf("WARN: unable to query: %s", err)
 			continue
@@ -44,6 +82,23 @@ func main() {
 	}
 }
 
+// lookup looks the name up with the stub resolver, if there is one, and
+// the resolver otherwise.
+func lookup(ctx context.Context, resolver *resolve.Resolver, stub *resolve.StubResolver, name string) (dns.Message, error) {
+	if stub != nil {
+		return stub.Lookup(ctx, name, dns.A)
+	}
+	host, err := dns.ParseName(name)
+	if err != nil {
+		return dns.Message{}, fmt.Errorf("invalid name %q: %w", name, err)
+	}
+	return resolver.Resolve(ctx, dns.Question{
+		Name:  host,
+		Type:  dns.A,
+		Class: dns.IN,
+	})
+}
+
 func printResource(r dns.Resource) {
 	fmt.Printf("  name: %s\n", r.Name)
 	fmt.Printf("    type: %s\n", r.Type)
@@ -1,34 +1,306 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"dns"
 	"dns/resolve"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io/fs"
+	"log/slog"
 	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
-	srv, err := NewServer(53)
+	port := flag.Int("port", 53, "UDP port to listen on")
+	rootHints := flag.String("root-hints", "", "named.root file to load root servers from, instead of the built-in hints")
+	family := flag.String("family", "happy-eyeballs", "address family for contacting name servers: ipv4, ipv6 or happy-eyeballs")
+	minTTL := flag.Duration("cache-min-ttl", 0, "minimum time to cache records for")
+	maxTTL := flag.Duration("cache-max-ttl", 7*24*time.Hour, "maximum time to cache records for")
+	cacheSize := flag.Int("cache-size", 100_000, "maximum number of entries to cache, or 0 for no limit")
+	serveStale := flag.Duration("serve-stale", 24*time.Hour, "how long to keep serving expired records when the authorities can't be reached, or 0 to never serve them")
+	staleAnswerTimeout := flag.Duration("stale-answer-timeout", 1800*time.Millisecond, "how long to wait for a fresh answer before serving an expired one, while resolution carries on")
+	prefetch := flag.Float64("prefetch", 0.1, "fraction of their TTL that popular records have left when they're refreshed in the background, or 0 to never prefetch")
+	prefetchMinHits := flag.Int("prefetch-min-hits", 3, "how many times a record must be used to be worth prefetching")
+	cacheFile := flag.String("cache-file", "", "file to save the cache to when stopping, and load it from when starting")
+	forward := flag.String("forward", "", "comma-separated addresses of upstream resolvers to forward queries to, instead of resolving them from the root")
+	forwardStrategy := flag.String("forward-strategy", "sequential", "how to choose upstreams to forward to: sequential, random, fastest or parallel")
+	qnameMinimisation := flag.String("qname-minimisation", "relaxed", "how much of each name to send to each zone's servers: off, relaxed or strict")
+	hostsFile := flag.String("hosts", "", "file in /etc/hosts format to answer from before resolving, which is reloaded when it changes")
+	logLevel := flag.String("log-level", "info", "least severe messages to log: debug, info, warn or error; debug logs every query")
+	logFormat := flag.String("log-format", "text", "how to format log messages: text or json")
+	metricsAddr := flag.String("metrics-addr", "", "address to serve Prometheus metrics from at /metrics, such as :9153; empty to not serve them")
+	var routes []resolve.Route
+	flag.Func("forward-zone", "zone=addr,... to forward questions about a zone to upstream resolvers; can be repeated", func(s string) error {
+		zone, addrs, err := parseZoneServers(s)
+		routes = append(routes, resolve.ForwardZone(zone, addrs...))
+		return err
+	})
+	flag.Func("stub-zone", "zone=addr,... to resolve questions about a zone from its authoritative servers; can be repeated", func(s string) error {
+		zone, addrs, err := parseZoneServers(s)
+		routes = append(routes, resolve.StubZone(zone, addrs...))
+		return err
+	})
+	flag.Parse()
+
+	logger, err := newLogger(*logLevel, *logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	srv, err := NewServer(*port, logger)
 	if err != nil {
-		log.Fatalf("Failed to create server: %v", err)
+		fatal(logger, "couldn't create server", err)
+	}
+	srv.resolver.Cache.MinTTL = *minTTL
+	srv.resolver.Cache.MaxTTL = *maxTTL
+	srv.resolver.Cache.MaxEntries = *cacheSize
+	srv.resolver.Cache.StaleWindow = *serveStale
+	srv.resolver.StaleAnswerTimeout = *staleAnswerTimeout
+	srv.resolver.PrefetchThreshold = *prefetch
+	srv.resolver.PrefetchMinHits = *prefetchMinHits
+	if *forward != "" {
+		route, err := forwardEverything(*forward, *forwardStrategy)
+		if err != nil {
+			fatal(logger, "invalid forwarding configuration", err)
+		}
+		routes = append(routes, route)
+	}
+	srv.setRoutes(routes)
+	if srv.resolver.Family, err = resolve.ParseAddressFamily(*family); err != nil {
+		fatal(logger, "invalid address family", err)
+	}
+	if srv.resolver.QNAMEMinimisation, err = resolve.ParseMinimisation(*qnameMinimisation); err != nil {
+		fatal(logger, "invalid QNAME minimisation mode", err)
 	}
+	if *rootHints != "" {
+		if err := loadRootHints(srv.resolver, *rootHints); err != nil {
+			fatal(logger, "couldn't load root hints", err)
+		}
+	}
+	if *hostsFile != "" {
+		if srv.hosts, err = resolve.LoadHostsFile(*hostsFile); err != nil {
+			fatal(logger, "couldn't load hosts file", err)
+		}
+		srv.hosts.Logger = logger
+	}
+	if *cacheFile != "" {
+		if err := loadCache(srv.resolver.Cache, *cacheFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logger.Warn("couldn't load cache", slog.String("path", *cacheFile), slog.Any("err", err))
+		}
+		go srv.saveCacheOnExit(*cacheFile)
+	}
+	if !srv.forwardsEverything() {
+		if err := srv.resolver.Prime(context.Background()); err != nil {
+			logger.Warn("couldn't prime root servers", slog.Any("err", err))
+		}
+	}
+	if *metricsAddr != "" {
+		go func() {
+			if err := srv.metrics.serve(*metricsAddr); err != nil {
+				fatal(logger, "couldn't serve metrics", err)
+			}
+		}()
+	}
+	go srv.dumpCacheOnSignal()
 	if err := srv.Listen(); err != nil {
-		log.Fatalf("Failed to start UDP listener: %v", err)
+		fatal(logger, "couldn't start UDP listener", err)
 	}
 }
 
+// newLogger creates a logger that writes messages of at least the named
+// level to stderr, in the named format.
+func newLogger(level, format string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	options := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, options)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+func fatal(logger *slog.Logger, msg string, err error) {
+	logger.Error(msg, slog.Any("err", err))
+	os.Exit(1)
+}
+
 type Server struct {
-	addr *net.UDPAddr
+	addr     *net.UDPAddr
+	resolver *resolve.Resolver
+
+	// hosts, if it's set, overrides the resolver.
+	hosts *resolve.HostsFile
+
+	logger  *slog.Logger
+	metrics *serverMetrics
 }
 
-func NewServer(port int) (*Server, error) {
+func NewServer(port int, logger *slog.Logger) (*Server, error) {
 	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return nil, err
 	}
-	return &Server{addr: addr}, nil
+	resolver := resolve.NewResolver()
+	resolver.Logger = logger
+	s := &Server{
+		addr:     addr,
+		resolver: resolver,
+		logger:   logger,
+	}
+	s.metrics = newServerMetrics(s)
+	resolver.Transport = s.metrics.meter(resolver.Transport, "udp")
+	return s, nil
+}
+
+// parseZoneServers parses a zone and the addresses of its servers, as
+// zone=addr,...
+func parseZoneServers(s string) (dns.Name, []net.IP, error) {
+	zoneString, servers, ok := strings.Cut(s, "=")
+	if !ok {
+		return nil, nil, fmt.Errorf("expected zone=addr,..., got %q", s)
+	}
+	zone, err := dns.ParseName(zoneString)
+	if err != nil {
+		return nil, nil, err
+	}
+	addrs, err := parseAddrs(servers)
+	return zone, addrs, err
+}
+
+func parseAddrs(s string) ([]net.IP, error) {
+	var addrs []net.IP
+	for _, field := range strings.Split(s, ",") {
+		addr := net.ParseIP(strings.TrimSpace(field))
+		if addr == nil {
+			return nil, fmt.Errorf("invalid address %q", field)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// forwardEverything makes a route that forwards questions about every
+// name to the comma-separated upstreams, instead of resolving them from
+// the root.  It's the least specific route, so any others still apply, as
+// does everything else that the resolver does, such as caching.
+func forwardEverything(upstreams string, strategy string) (resolve.Route, error) {
+	addrs, err := parseAddrs(upstreams)
+	if err != nil {
+		return resolve.Route{}, err
+	}
+	route := resolve.ForwardZone(dns.Name{}, addrs...)
+	route.Forwarder.Strategy, err = resolve.ParseStrategy(strategy)
+	return route, err
+}
+
+// setRoutes gives the routes to the resolver, with its logger and metrics.
+func (s *Server) setRoutes(routes []resolve.Route) {
+	for _, route := range routes {
+		if route.Forwarder != nil {
+			route.Forwarder.Logger = s.logger
+			s.metrics.meterForwarder(route.Forwarder)
+		}
+		s.metrics.countServers(route.Servers...)
+	}
+	s.resolver.Routes = routes
+}
+
+// forwardsEverything checks whether the root zone is forwarded, in which
+// case the root servers are never used.
+func (s *Server) forwardsEverything() bool {
+	for _, route := range s.resolver.Routes {
+		if len(route.Zone) == 0 && route.Forwarder != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) resolve(ctx context.Context, question dns.Question) (dns.Message, error) {
+	if s.hosts != nil {
+		if answers, ok := s.hosts.Lookup(question); ok {
+			return dns.Message{Answers: answers}, nil
+		}
+	}
+	return s.resolver.Resolve(ctx, question)
+}
+
+func loadRootHints(resolver *resolve.Resolver, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return resolver.LoadRootHints(f)
+}
+
+func loadCache(cache *resolve.Cache, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return cache.ReadSnapshot(f)
+}
+
+// saveCache writes the cache to a temporary file first, so that a crash
+// part-way through doesn't leave a broken snapshot behind.
+func saveCache(cache *resolve.Cache, path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := cache.WriteSnapshot(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// saveCacheOnExit saves the cache when the server is told to stop, so that
+// it can carry on where it left off when it starts again.
+func (s *Server) saveCacheOnExit(path string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	if err := saveCache(s.resolver.Cache, path); err != nil {
+		fatal(s.logger, "couldn't save cache", err)
+	}
+	s.logger.Info("saved cache", slog.String("path", path))
+	os.Exit(0)
+}
+
+// dumpCacheOnSignal logs the cache's stats, and prints its contents,
+// whenever the server gets a SIGUSR1.
+func (s *Server) dumpCacheOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	for range signals {
+		s.logger.Info("cache stats", slog.Any("stats", s.resolver.Cache.Stats()))
+		if err := s.resolver.Cache.Dump(os.Stdout); err != nil {
+			s.logger.Warn("couldn't dump cache", slog.Any("err", err))
+		}
+	}
 }
 
 func (s *Server) Listen() error {
@@ -38,7 +310,7 @@ func (s *Server) Listen() error {
 	}
 	defer conn.Close()
 
-	fmt.Printf("Listening for UDP packets on port %d\n", s.addr.Port)
+	s.logger.Info("listening for UDP packets", slog.Int("port", s.addr.Port))
 
 	buffer := make([]byte, 1024)
 	for {
@@ -48,49 +320,88 @@ func (s *Server) Listen() error {
 		}
 		msg, err := dns.ParseMessage(buffer[:n])
 		if err != nil {
-			fmt.Printf("couldn't parse message: %s\n", err)
+			s.logger.Debug("couldn't parse query", slog.String("client", addr.String()), slog.Any("err", err))
 			continue
 		}
 
-		go handle(msg, conn, addr)
+		go s.handle(msg, conn, addr)
 	}
 }
 
-func handle(qry dns.Message, conn *net.UDPConn, rspAddr *net.UDPAddr) {
+// ednsUDPSize is the largest UDP message that we tell clients we can
+// receive.
+// It matches the buffer that we read queries into.
+const ednsUDPSize = 1024
+
+func (s *Server) handle(qry dns.Message, conn *net.UDPConn, rspAddr *net.UDPAddr) {
+	handleStart := time.Now()
 	rsp := dns.MakeResponse(qry)
+	var options []dns.EDNSOption
 	// TODO: reject queries with more than one question
 	for _, question := range qry.Questions {
-		resolved, err := resolve.Resolve(question)
+		start := time.Now()
+		resolved, err := s.resolve(context.Background(), question)
 		if err != nil {
-			fmt.Printf("couldn't resolve %q/%s: %s\n",
-				question.Name, question.Type, err)
+			s.logger.Info("couldn't resolve",
+				slog.String("client", rspAddr.String()),
+				slog.String("qname", question.Name.String()),
+				slog.String("qtype", question.Type.String()),
+				slog.Duration("duration", time.Since(start)),
+				slog.Any("err", err))
+			// an empty NOERROR would tell the client that there's
+			// nothing to find, which it might cache:
+			rsp.Flags = rsp.Flags.WithResponseCode(dns.ServerFailure)
+			options = append(options, dns.NewExtendedError(dns.NoReachableAuthority, ""))
 		} else {
-			// TODO: inspect resolved msg header for reply codes
-			logRsp(question, resolved)
+			s.logger.Debug("answered",
+				slog.String("client", rspAddr.String()),
+				slog.String("qname", question.Name.String()),
+				slog.String("qtype", question.Type.String()),
+				slog.String("rcode", resolved.Flags.ResponseCode().String()),
+				slog.Duration("duration", time.Since(start)),
+				slog.Any("answers", describeAnswers(resolved.Answers)))
+			rsp.Flags = rsp.Flags.WithResponseCode(resolved.Flags.ResponseCode())
 			rsp.Answers = append(rsp.Answers, resolved.Answers...)
 			rsp.Authorities = append(rsp.Authorities, resolved.Authorities...)
-			rsp.Additional = append(rsp.Additional, resolved.Additional...)
+			for _, additional := range resolved.Additional {
+				if additional.Type != dns.OPT {
+					rsp.Additional = append(rsp.Additional, additional)
+					continue
+				}
+				// EDNS is between us and the client, so only the options
+				// that describe the answer are passed on:
+				resolvedOptions, _ := dns.EDNSOptions(additional)
+				for _, option := range resolvedOptions {
+					if option.Code == dns.ExtendedDNSError {
+						options = append(options, option)
+					}
+				}
+			}
 		}
 	}
+	if _, ok := qry.FindOPT(); ok {
+		rsp.Additional = append(rsp.Additional, dns.NewOPT(ednsUDPSize, options...))
+	}
 
 	rspBuf := make([]byte, 0, 1024)
 	rspBuf, err := rsp.WriteTo(rspBuf)
 	if err != nil {
-		fmt.Printf("failed to write response: %s\n", err)
+		s.logger.Warn("couldn't write response", slog.Any("err", err))
 		return
 	}
 
 	_, err = conn.WriteToUDP(rspBuf, rspAddr)
+	s.metrics.response("udp", qry, rsp, handleStart)
 	if err != nil {
-		fmt.Printf("failed to send response to %s: %s", rspAddr.String(), err)
+		s.logger.Warn("couldn't send response", slog.String("client", rspAddr.String()), slog.Any("err", err))
 	}
 }
 
-func logRsp(question dns.Question, rsp dns.Message) {
-	var buf bytes.Buffer
-	fmt.Fprintf(&buf, "%s/%s? -> ", question.Name, question.Type)
-	for _, answer := range rsp.Answers {
-		fmt.Fprintf(&buf, "%s=(%s), ", answer.Name, answer.Data)
+// describeAnswers describes each answer as name=(data), for logging.
+func describeAnswers(answers []dns.Resource) []string {
+	described := make([]string, 0, len(answers))
+	for _, answer := range answers {
+		described = append(described, fmt.Sprintf("%s=(%s)", answer.Name, answer.Data))
 	}
-	fmt.Println(buf.String())
+	return described
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"dns"
+	"dns/metrics"
+	"dns/resolve"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Metrics about the queries that the server answers, and the queries that
+// it sends to answer them, for Prometheus to scrape from /metrics.
+//
+// Upstream queries are only counted per server for the servers that we're
+// configured with, such as forwarders.  Authoritative servers are chosen by
+// whoever sends us referrals, who could make us keep series for as many of
+// them as they liked, so they're all counted as "other".  Likewise, query
+// types are only counted separately if we know them, since clients can
+// ask for any of 65536.
+
+type serverMetrics struct {
+	registry *metrics.Registry
+
+	queries  *metrics.Counter
+	duration *metrics.Histogram
+
+	upstreamQueries  *metrics.Counter
+	upstreamTimeouts *metrics.Counter
+
+	// servers are the upstreams that are counted separately.  It's only
+	// changed while the server is being set up.
+	servers map[string]bool
+}
+
+func newServerMetrics(s *Server) *serverMetrics {
+	r := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry: r,
+		queries: r.Counter("dns_queries_total",
+			"Questions answered, by query type, response code and transport.",
+			"qtype", "rcode", "transport"),
+		duration: r.Histogram("dns_response_duration_seconds",
+			"How long it took to respond to queries, by transport.",
+			metrics.DefaultBuckets, "transport"),
+		upstreamQueries: r.Counter("dns_upstream_queries_total",
+			"Queries sent to other servers, by server and transport.",
+			"server", "transport"),
+		upstreamTimeouts: r.Counter("dns_upstream_timeouts_total",
+			"Queries sent to other servers that timed out, by server and transport.",
+			"server", "transport"),
+		servers: make(map[string]bool),
+	}
+
+	// the cache's stats are read once per scrape, since reading them
+	// locks the whole cache:
+	stats := cacheStatsSnapshot(s.resolver.Cache)
+	r.OnScrape(stats.refresh)
+	r.CounterFunc("dns_cache_hits_total", "Answers found in the cache.", func() float64 {
+		return float64(stats.get().Hits)
+	})
+	r.CounterFunc("dns_cache_misses_total", "Answers not found in the cache.", func() float64 {
+		return float64(stats.get().Misses)
+	})
+	r.CounterFunc("dns_cache_negative_hits_total", "Negative answers found in the cache.", func() float64 {
+		return float64(stats.get().NegativeHits)
+	})
+	r.CounterFunc("dns_cache_negative_misses_total", "Negative answers not found in the cache.", func() float64 {
+		return float64(stats.get().NegativeMisses)
+	})
+	r.CounterFunc("dns_cache_stale_hits_total", "Stale answers served from the cache.", func() float64 {
+		return float64(stats.get().StaleHits)
+	})
+	r.CounterFunc("dns_cache_evictions_total", "Cache entries removed to make room.", func() float64 {
+		return float64(stats.get().Evictions)
+	})
+	r.GaugeFunc("dns_cache_entries", "Entries in the cache, including expired ones that haven't been removed.", func() float64 {
+		return float64(stats.get().Size)
+	})
+	r.GaugeFunc("dns_inflight_resolutions", "Resolutions in progress.", func() float64 {
+		return float64(s.resolver.InFlight())
+	})
+	return m
+}
+
+// cacheStats holds the cache's stats from the start of a scrape.
+type cacheStats struct {
+	cache *resolve.Cache
+	mutex sync.Mutex
+	stats resolve.CacheStats
+}
+
+func cacheStatsSnapshot(cache *resolve.Cache) *cacheStats {
+	return &cacheStats{cache: cache}
+}
+
+func (c *cacheStats) refresh() {
+	stats := c.cache.Stats()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.stats = stats
+}
+
+func (c *cacheStats) get() resolve.CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.stats
+}
+
+// response records the response to a query, which took since start.
+func (m *serverMetrics) response(transport string, qry, rsp dns.Message, start time.Time) {
+	rcode := rsp.Flags.ResponseCode().String()
+	for _, question := range qry.Questions {
+		m.queries.Inc(qtypeLabel(question.Type), rcode, transport)
+	}
+	m.duration.Observe(time.Since(start).Seconds(), transport)
+}
+
+func qtypeLabel(qtype dns.QueryType) string {
+	switch qtype {
+	case dns.A, dns.NS, dns.MD, dns.MF, dns.CNAME, dns.SOA, dns.MB, dns.MG, dns.MR,
+		dns.NULL, dns.WKS, dns.PTR, dns.HINFO, dns.MINFO, dns.MX, dns.TXT,
+		dns.AAAA, dns.DNAME, dns.OPT, dns.AXFR, dns.MAILB, dns.MAILA, dns.ANY_QUERY:
+		return qtype.String()
+	default:
+		return "other"
+	}
+}
+
+// meter wraps a Transport, so that the queries sent with it are counted
+// under the name of the transport.
+func (m *serverMetrics) meter(transport resolve.Transport, name string) resolve.Transport {
+	return meteredTransport{Transport: transport, name: name, metrics: m}
+}
+
+type meteredTransport struct {
+	resolve.Transport
+	name    string
+	metrics *serverMetrics
+}
+
+func (t meteredTransport) Exchange(ctx context.Context, server net.IP, query dns.Message) (dns.Message, error) {
+	rsp, err := t.Transport.Exchange(ctx, server, query)
+	label := t.metrics.serverLabel(server)
+	t.metrics.upstreamQueries.Inc(label, t.name)
+	if resolve.IsTimeout(err) {
+		t.metrics.upstreamTimeouts.Inc(label, t.name)
+	}
+	return rsp, err
+}
+
+// countServers makes the upstream metrics count the servers separately.
+func (m *serverMetrics) countServers(servers ...net.IP) {
+	for _, server := range servers {
+		m.servers[server.String()] = true
+	}
+}
+
+func (m *serverMetrics) serverLabel(server net.IP) string {
+	if m.servers[server.String()] {
+		return server.String()
+	}
+	return "other"
+}
+
+// meterForwarder meters the transports of a Forwarder, counting each of its
+// upstreams separately.
+func (m *serverMetrics) meterForwarder(f *resolve.Forwarder) {
+	m.countServers(f.Upstreams...)
+	f.Transport = m.meter(f.Transport, "udp")
+	f.TCPTransport = m.meter(f.TCPTransport, "tcp")
+}
+
+// serve serves the metrics over HTTP at /metrics, until it fails.
+func (m *serverMetrics) serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.registry)
+	return http.ListenAndServe(addr, mux)
+}
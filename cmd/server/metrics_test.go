@@ -0,0 +1,35 @@
+package main
+
+import (
+	"dns"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnknownQueryTypesShareALabel(t *testing.T) {
+	s, err := NewServer(0, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, qtype := range []dns.QueryType{dns.A, 65280, 65281} {
+		qry := dns.Message{Questions: []dns.Question{{
+			Name:  dns.Name{"www", "example", "com"},
+			Type:  qtype,
+			Class: dns.IN,
+		}}}
+		s.metrics.response("udp", qry, dns.MakeResponse(qry), time.Now())
+	}
+
+	var got strings.Builder
+	if _, err := s.metrics.registry.WriteTo(&got); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(got.String(), `dns_queries_total{qtype="A",rcode="NoError",transport="udp"} 1`) {
+		t.Errorf("expected A to be counted by itself, got:\n%s", got.String())
+	}
+	if !strings.Contains(got.String(), `dns_queries_total{qtype="other",rcode="NoError",transport="udp"} 2`) {
+		t.Errorf("expected the unknown types to be counted together, got:\n%s", got.String())
+	}
+}
@@ -0,0 +1,109 @@
+package dns
+
+import (
+	"fmt"
+	"slices"
+)
+
+// EDNS (RFC 6891) is carried in an OPT pseudo-resource in the additional
+// section.  Its class holds the largest UDP payload that the sender can
+// handle, and its data holds a list of options.  For now, the extended
+// response code, version and flags that live in its TTL are left as they
+// are.
+
+// EDNSOptionCode identifies an option in an OPT resource.
+type EDNSOptionCode uint16
+
+const (
+	// ExtendedDNSError options explain why a response is the way it is,
+	// as in RFC 8914.
+	ExtendedDNSError EDNSOptionCode = 15
+)
+
+type EDNSOption struct {
+	Code EDNSOptionCode
+	Data []byte
+}
+
+// NewOPT creates an OPT resource for the additional section of a message.
+func NewOPT(udpSize uint16, options ...EDNSOption) Resource {
+	var data []byte
+	for _, option := range options {
+		data = be.AppendUint16(data, uint16(option.Code))
+		data = be.AppendUint16(data, uint16(len(option.Data)))
+		data = append(data, option.Data...)
+	}
+	return Resource{
+		Name:  Name{},
+		Type:  OPT,
+		Class: QueryClass(udpSize),
+		Data:  data,
+	}
+}
+
+// FindOPT finds the OPT resource in a message, if it has one.
+func (m Message) FindOPT() (Resource, bool) {
+	for _, res := range m.Additional {
+		if res.Type == OPT {
+			return res, true
+		}
+	}
+	return Resource{}, false
+}
+
+// EDNSOptions parses the options in an OPT resource.
+func EDNSOptions(opt Resource) ([]EDNSOption, error) {
+	data, ok := opt.Data.([]byte)
+	if opt.Type != OPT || !ok {
+		return nil, fmt.Errorf("mismatched resource type %s / %T",
+			opt.Type, opt.Data)
+	}
+
+	buf := readBuf{data, 0}
+	var options []EDNSOption
+	for buf.pos < len(data) {
+		code, _ := as[EDNSOptionCode](buf.Uint16())
+		length, _ := buf.Uint16()
+		optionData, err := buf.Slice(int(length))
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, EDNSOption{
+			Code: code,
+			Data: slices.Clone(optionData),
+		})
+	}
+	return options, nil
+}
+
+// ExtendedErrorCode is the info code of an extended DNS error.
+type ExtendedErrorCode uint16
+
+const (
+	OtherError           ExtendedErrorCode = 0
+	StaleAnswer          ExtendedErrorCode = 3
+	StaleNXDomainAnswer  ExtendedErrorCode = 19
+	NoReachableAuthority ExtendedErrorCode = 22
+)
+
+// NewExtendedError creates an extended DNS error option, with some text
+// for humans that may be empty.
+func NewExtendedError(code ExtendedErrorCode, text string) EDNSOption {
+	data := be.AppendUint16(nil, uint16(code))
+	data = append(data, text...)
+	return EDNSOption{Code: ExtendedDNSError, Data: data}
+}
+
+// ParseExtendedError parses the info code and text of an extended DNS
+// error option.
+func ParseExtendedError(option EDNSOption) (ExtendedErrorCode, string, error) {
+	if option.Code != ExtendedDNSError {
+		return 0, "", fmt.Errorf("not an extended DNS error: option %d", option.Code)
+	}
+	buf := readBuf{option.Data, 0}
+	code, err := as[ExtendedErrorCode](buf.Uint16())
+	if err != nil {
+		return 0, "", err
+	}
+	return code, string(option.Data[2:]), nil
+}
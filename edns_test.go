@@ -0,0 +1,54 @@
+package dns_test
+
+import (
+	"dns"
+	"testing"
+)
+
+func TestRoundTripExtendedError(t *testing.T) {
+	msg := dns.Message{
+		ID:    1,
+		Flags: dns.Flags(0).WithType(dns.Response),
+		Additional: []dns.Resource{
+			dns.NewOPT(1232, dns.NewExtendedError(dns.StaleAnswer, "stale")),
+		},
+	}
+	b, err := msg.WriteTo(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := dns.ParseMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opt, ok := parsed.FindOPT()
+	if !ok {
+		t.Fatal("expected an OPT resource")
+	}
+	if opt.Class != 1232 {
+		t.Errorf("expected a UDP payload size of 1232, got %d", opt.Class)
+	}
+	options, err := dns.EDNSOptions(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(options) != 1 {
+		t.Fatalf("expected 1 option, got %d", len(options))
+	}
+	code, text, err := dns.ParseExtendedError(options[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != dns.StaleAnswer || text != "stale" {
+		t.Errorf("expected stale answer error, got %d %q", code, text)
+	}
+}
+
+func TestEDNSOptionsTooShort(t *testing.T) {
+	opt := dns.NewOPT(1232, dns.NewExtendedError(dns.StaleAnswer, ""))
+	opt.Data = opt.Data.([]byte)[:5]
+	if _, err := dns.EDNSOptions(opt); err == nil {
+		t.Error("expected an error for a truncated option")
+	}
+}
@@ -29,3 +29,20 @@ func TestFlagSetting(t *testing.T) {
 			fOrig, fQry)
 	}
 }
+
+func TestResponseCodeSetting(t *testing.T) {
+	fOrig := dns.Flags(0).WithType(dns.Response)
+	fErr := fOrig.WithResponseCode(dns.NameError)
+	if fErr.ResponseCode() != dns.NameError {
+		t.Errorf("expected NameError, got %s", fErr.ResponseCode())
+	}
+	if fErr.Type() != dns.Response {
+		t.Errorf("expected type to be unchanged, got %s", fErr.Type())
+	}
+
+	fOK := fErr.WithResponseCode(dns.NoError)
+	if fOK != fOrig {
+		t.Errorf("all other fields should remain unchanged, exp %#b, got %#b",
+			fOrig, fOK)
+	}
+}
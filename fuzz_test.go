@@ -13,6 +13,7 @@ func FuzzParseMessage(f *testing.F) {
 	f.Add(googleMXResponse)
 	f.Add(googleRootAResponse)
 	f.Add(cnameWithMultipleAnswers)
+	f.Add(dnameResponse)
 	f.Fuzz(func(t *testing.T, buf []byte) {
 		_, err := dns.ParseMessage(buf)
 		if !isExpectedParseError(err) {
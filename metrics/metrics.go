@@ -0,0 +1,355 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics in the Prometheus text exposition format, without depending on
+// the Prometheus client library.
+//
+// Each metric can have labels, whose values are given whenever it's
+// updated, and every combination of values that's been seen is a separate
+// series.  Giving the wrong number of values is a programming error, so it
+// panics.
+//
+// Metrics whose values live somewhere else, such as a cache's own
+// counters, can be read from a function whenever they're exposed instead.
+
+// DefaultBuckets are the upper bounds of a Histogram's buckets, in seconds,
+// suitable for timing network requests.  They're Prometheus's defaults.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry is a set of metrics that are exposed together.
+type Registry struct {
+	mutex   sync.Mutex
+	metrics []metric
+	names   map[string]bool
+	scrapes []func()
+}
+
+type metric interface {
+	write(buf *bytes.Buffer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+func (r *Registry) register(name string, m metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.names[name] {
+		panic(fmt.Sprintf("metric %s registered twice", name))
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// OnScrape registers fn to be called before the metrics are written, such
+// as to take one snapshot of values that several functions read, when
+// that's expensive.
+func (r *Registry) OnScrape(fn func()) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.scrapes = append(r.scrapes, fn)
+}
+
+// WriteTo writes every metric in the text exposition format, in the order
+// that they were registered.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mutex.Lock()
+	metrics := slices.Clone(r.metrics)
+	scrapes := slices.Clone(r.scrapes)
+	r.mutex.Unlock()
+
+	for _, fn := range scrapes {
+		fn()
+	}
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		m.write(&buf)
+	}
+	return buf.WriteTo(w)
+}
+
+// ServeHTTP serves the metrics, for Prometheus to scrape.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// family is the part of a metric that's shared by all its series.
+type family struct {
+	name, help, kind string
+	labels           []string
+}
+
+func (f family) writeHeader(buf *bytes.Buffer) {
+	help := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(f.help)
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", f.name, help, f.name, f.kind)
+}
+
+// key identifies the series for some label values.  The separator sorts
+// before anything else, so that series are exposed in order of their
+// values.
+func (f family) key(values []string) string {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values",
+			f.name, len(f.labels), len(values)))
+	}
+	return strings.Join(values, "\x00")
+}
+
+// writeSample writes one line of a series, with any extra label after its
+// own.
+func writeSample(buf *bytes.Buffer, name string, labels, values []string, extra string, value float64) {
+	buf.WriteString(name)
+	if len(labels) > 0 || extra != "" {
+		buf.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			fmt.Fprintf(buf, "%s=%s", label, quoteLabel(values[i]))
+		}
+		if extra != "" {
+			if len(labels) > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(extra)
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(formatValue(value))
+	buf.WriteByte('\n')
+}
+
+func quoteLabel(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+// values is the series of a counter or gauge.
+type values struct {
+	family
+	mutex  sync.Mutex
+	series map[string]*sample
+}
+
+type sample struct {
+	values []string
+	value  float64
+}
+
+func newValues(name, help, kind string, labels []string) *values {
+	return &values{
+		family: family{name: name, help: help, kind: kind, labels: labels},
+		series: make(map[string]*sample),
+	}
+}
+
+// update calls fn with the series for the label values, creating it if
+// necessary.
+func (v *values) update(labelValues []string, fn func(*sample)) {
+	key := v.key(labelValues)
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	s, ok := v.series[key]
+	if !ok {
+		s = &sample{values: slices.Clone(labelValues)}
+		v.series[key] = s
+	}
+	fn(s)
+}
+
+func (v *values) write(buf *bytes.Buffer) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.writeHeader(buf)
+	for _, key := range sortedKeys(v.series) {
+		s := v.series[key]
+		writeSample(buf, v.name, v.labels, s.values, "", s.value)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// Counter is a value that only goes up, such as a number of queries.
+type Counter struct {
+	values *values
+}
+
+// Counter registers a new counter with the given labels.  By convention,
+// its name ends in _total.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	c := &Counter{values: newValues(name, help, "counter", labels)}
+	r.register(name, c.values)
+	return c
+}
+
+// Inc adds one to the series for the label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds delta, which mustn't be negative, to the series for the label
+// values.
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic(fmt.Sprintf("counter %s can't go down", c.values.name))
+	}
+	c.values.update(labelValues, func(s *sample) {
+		s.value += delta
+	})
+}
+
+// Gauge is a value that can go up and down, such as a number of
+// resolutions in progress.
+type Gauge struct {
+	values *values
+}
+
+// Gauge registers a new gauge with the given labels.
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{values: newValues(name, help, "gauge", labels)}
+	r.register(name, g.values)
+	return g
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.values.update(labelValues, func(s *sample) {
+		s.value = value
+	})
+}
+
+func (g *Gauge) Add(delta float64, labelValues ...string) {
+	g.values.update(labelValues, func(s *sample) {
+		s.value += delta
+	})
+}
+
+// valueFunc is a metric without labels, whose value is read when it's
+// exposed.
+type valueFunc struct {
+	family
+	fn func() float64
+}
+
+func (v valueFunc) write(buf *bytes.Buffer) {
+	v.writeHeader(buf)
+	writeSample(buf, v.name, nil, nil, "", v.fn())
+}
+
+// CounterFunc registers a counter whose value is read from fn, which must
+// be safe to call from any goroutine.
+func (r *Registry) CounterFunc(name, help string, fn func() float64) {
+	r.register(name, valueFunc{family{name: name, help: help, kind: "counter"}, fn})
+}
+
+// GaugeFunc registers a gauge whose value is read from fn, which must be
+// safe to call from any goroutine.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	r.register(name, valueFunc{family{name: name, help: help, kind: "gauge"}, fn})
+}
+
+// Histogram counts observations, such as response times, in buckets.
+type Histogram struct {
+	family
+	buckets []float64
+
+	mutex  sync.Mutex
+	series map[string]*distribution
+}
+
+type distribution struct {
+	values []string
+	// counts[i] counts the observations in bucket i alone; they're added
+	// up when they're exposed.  The last one is for +Inf.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Histogram registers a new histogram with the given bucket upper bounds,
+// which must be in increasing order, and labels.  By convention, a
+// histogram of times is in seconds, and its name ends in _seconds.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if !slices.IsSorted(buckets) {
+		panic(fmt.Sprintf("histogram %s has buckets out of order", name))
+	}
+	h := &Histogram{
+		family:  family{name: name, help: help, kind: "histogram", labels: labels},
+		buckets: slices.Clone(buckets),
+		series:  make(map[string]*distribution),
+	}
+	r.register(name, h)
+	return h
+}
+
+// Observe adds an observation to the series for the label values.
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	d, ok := h.series[key]
+	if !ok {
+		d = &distribution{
+			values: slices.Clone(labelValues),
+			counts: make([]uint64, len(h.buckets)+1),
+		}
+		h.series[key] = d
+	}
+	i, _ := slices.BinarySearch(h.buckets, value)
+	d.counts[i]++
+	d.sum += value
+	d.count++
+}
+
+func (h *Histogram) write(buf *bytes.Buffer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.writeHeader(buf)
+	for _, key := range sortedKeys(h.series) {
+		d := h.series[key]
+		var cumulative uint64
+		for i, count := range d.counts {
+			cumulative += count
+			bound := math.Inf(1)
+			if i < len(h.buckets) {
+				bound = h.buckets[i]
+			}
+			writeSample(buf, h.name+"_bucket", h.labels, d.values,
+				"le="+quoteLabel(formatValue(bound)), float64(cumulative))
+		}
+		writeSample(buf, h.name+"_sum", h.labels, d.values, "", d.sum)
+		writeSample(buf, h.name+"_count", h.labels, d.values, "", float64(d.count))
+	}
+}
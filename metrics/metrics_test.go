@@ -0,0 +1,95 @@
+package metrics_test
+
+import (
+	"dns/metrics"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	r := metrics.NewRegistry()
+	queries := r.Counter("dns_queries_total", "Queries received.", "qtype", "rcode")
+	inflight := r.Gauge("dns_inflight", "Resolutions in progress.")
+	r.CounterFunc("dns_cache_hits_total", "Cache hits.", func() float64 { return 7 })
+	latency := r.Histogram("dns_duration_seconds", "How long queries took.", []float64{0.1, 1}, "qtype")
+
+	queries.Inc("A", "NoError")
+	queries.Inc("A", "NoError")
+	queries.Add(3, "AAAA", `Odd "one"`)
+	inflight.Add(2)
+	inflight.Add(-1)
+	latency.Observe(0.05, "A")
+	latency.Observe(0.1, "A")
+	latency.Observe(2, "A")
+
+	want := `# HELP dns_queries_total Queries received.
+# TYPE dns_queries_total counter
+dns_queries_total{qtype="A",rcode="NoError"} 2
+dns_queries_total{qtype="AAAA",rcode="Odd \"one\""} 3
+# HELP dns_inflight Resolutions in progress.
+# TYPE dns_inflight gauge
+dns_inflight 1
+# HELP dns_cache_hits_total Cache hits.
+# TYPE dns_cache_hits_total counter
+dns_cache_hits_total 7
+# HELP dns_duration_seconds How long queries took.
+# TYPE dns_duration_seconds histogram
+dns_duration_seconds_bucket{qtype="A",le="0.1"} 2
+dns_duration_seconds_bucket{qtype="A",le="1"} 2
+dns_duration_seconds_bucket{qtype="A",le="+Inf"} 3
+dns_duration_seconds_sum{qtype="A"} 2.15
+dns_duration_seconds_count{qtype="A"} 3
+`
+	var got strings.Builder
+	if _, err := r.WriteTo(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, got.String())
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := metrics.NewRegistry()
+	r.Counter("requests_total", "Requests.").Inc()
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("expected the text format, got %s", ct)
+	}
+	if !strings.Contains(rec.Body.String(), "requests_total 1\n") {
+		t.Errorf("expected the counter, got:\n%s", rec.Body.String())
+	}
+}
+
+func TestWrongNumberOfLabelsPanics(t *testing.T) {
+	r := metrics.NewRegistry()
+	c := r.Counter("queries_total", "Queries.", "qtype")
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic")
+		}
+	}()
+	c.Inc("A", "NoError")
+}
+
+func TestOnScrape(t *testing.T) {
+	r := metrics.NewRegistry()
+	var scrapes, snapshot int
+	r.OnScrape(func() {
+		scrapes++
+		snapshot = scrapes * 10
+	})
+	r.GaugeFunc("a", "A.", func() float64 { return float64(snapshot) })
+	r.GaugeFunc("b", "B.", func() float64 { return float64(snapshot + 1) })
+
+	var got strings.Builder
+	if _, err := r.WriteTo(&got); err != nil {
+		t.Fatal(err)
+	}
+	if scrapes != 1 || !strings.Contains(got.String(), "a 10\n") || !strings.Contains(got.String(), "b 11\n") {
+		t.Errorf("expected one snapshot to be used for both, got %d scrapes:\n%s", scrapes, got.String())
+	}
+}
@@ -158,6 +158,24 @@ func writeResource(buf []byte, nc NameCompressor, res Resource) ([]byte, error)
 		buf = writeVariableLengthDataToBuf(buf, func(buf []byte) []byte {
 			return writeName(buf, nc, name)
 		})
+	case PTR:
+		name, ok := res.Data.(Name)
+		if !ok {
+			return nil, fmt.Errorf("mismatched resource type %s / %T",
+				res.Type, res.Data)
+		}
+		buf = writeVariableLengthDataToBuf(buf, func(buf []byte) []byte {
+			return writeName(buf, nc, name)
+		})
+	case DNAME:
+		name, ok := res.Data.(Name)
+		if !ok {
+			return nil, fmt.Errorf("mismatched resource type %s / %T",
+				res.Type, res.Data)
+		}
+		buf = writeVariableLengthDataToBuf(buf, func(buf []byte) []byte {
+			return writeUncompressedName(buf, nc, name)
+		})
 	case MX:
 		mx, ok := res.Data.(MXRecord)
 		if !ok {
@@ -234,6 +252,20 @@ func writeName(buf []byte, nc NameCompressor, name Name) []byte {
 	return buf
 }
 
+// writeUncompressedName writes the whole name, for places where
+// compression isn't allowed (eg, RFC 6672), but still allows later names
+// to point into it.
+func writeUncompressedName(buf []byte, nc NameCompressor, name Name) []byte {
+	nc.Compress(uint16(len(buf)), name)
+
+	for _, label := range name {
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, []byte(label)...)
+	}
+
+	return append(buf, 0)
+}
+
 func parseQuestions(buf readBuf, numQuestions uint16) ([]Question, readBuf, error) {
 	if numQuestions == 0 {
 		return nil, buf, nil
@@ -351,14 +383,26 @@ func (f Flags) Truncated() bool {
 	return f.boolInBit(9)
 }
 
+func (f Flags) WithTruncated(val bool) Flags {
+	return f.withBoolInBit(9, val)
+}
+
 func (f Flags) RecursionDesired() bool {
 	return f.boolInBit(8)
 }
 
+func (f Flags) WithRecursionDesired(val bool) Flags {
+	return f.withBoolInBit(8, val)
+}
+
 func (f Flags) RecursionAvailable() bool {
 	return f.boolInBit(7)
 }
 
+func (f Flags) WithRecursionAvailable(val bool) Flags {
+	return f.withBoolInBit(7, val)
+}
+
 // TODO: there are more flags in here
 // TCP/IP Illustrated says there are 3 reserved bits here
 // but wireshark shows some info about authentication in
@@ -368,6 +412,10 @@ func (f Flags) ResponseCode() ResponseCode {
 	return ResponseCode(uint16(f) & 0b1111)
 }
 
+func (f Flags) WithResponseCode(rc ResponseCode) Flags {
+	return Flags(uint16(f)&^0b1111 | uint16(rc)&0b1111)
+}
+
 type Question struct {
 	Name  Name
 	Type  QueryType
@@ -417,6 +465,10 @@ const (
 
 	AAAA QueryType = 28
 
+	DNAME QueryType = 39
+
+	OPT QueryType = 41
+
 	AXFR      QueryType = 252
 	MAILB     QueryType = 253
 	MAILA     QueryType = 254
@@ -492,6 +544,18 @@ func parseResource(buf readBuf) (Resource, readBuf, error) {
 			return Resource{}, buf, err
 		}
 
+	} else if qType == PTR {
+		resourceData, buf, err = parseName(buf)
+		if err != nil {
+			return Resource{}, buf, err
+		}
+
+	} else if qType == DNAME {
+		resourceData, buf, err = parseName(buf)
+		if err != nil {
+			return Resource{}, buf, err
+		}
+
 	} else if qType == SOA {
 		var mName, rName Name
 		mName, buf, err = parseName(buf)
@@ -284,6 +284,123 @@ func TestParseResponseWithCNAME(t *testing.T) {
 	}
 }
 
+// a made-up response where example.com has been redirected to example.net
+var dnameResponse = []byte{
+	0x12, 0x34,
+	0x81, 0x80,
+	0x00, 0x01,
+	0x00, 0x02,
+	0x00, 0x00,
+	0x00, 0x00,
+	// question 1 - 12..
+	0x03, 0x77, 0x77, 0x77,
+	0x07, 0x65, 0x78, 0x61, 0x6d, 0x70, 0x6c, 0x65, // 16, "example"
+	0x03, 0x63, 0x6f, 0x6d,
+	0x00,
+	0x00, 0x01,
+	0x00, 0x01,
+	// answer 1 - 33..
+	0xc0, 0x10,
+	0x00, 0x27, // DNAME
+	0x00, 0x01,
+	0x00, 0x00, 0x0e, 0x10,
+	0x00, 0x0d,
+	// uncompressed, as required by RFC 6672:
+	0x07, 0x65, 0x78, 0x61, 0x6d, 0x70, 0x6c, 0x65, // 45, "example"
+	0x03, 0x6e, 0x65, 0x74,
+	0x00,
+	// answer 2, synthesised from the DNAME
+	0xc0, 0x0c,
+	0x00, 0x05,
+	0x00, 0x01,
+	0x00, 0x00, 0x0e, 0x10,
+	0x00, 0x06,
+	0x03, 0x77, 0x77, 0x77,
+	0xc0, 0x2d, // pointer into the DNAME
+}
+
+func TestParseResponseWithDNAME(t *testing.T) {
+	rsp, err := dns.ParseMessage(dnameResponse)
+	if err != nil {
+		t.Fatalf("unexpected error parsing: %s", err)
+	}
+
+	if count := len(rsp.Answers); count != 2 {
+		t.Fatalf("expected 2 answers, got %d", count)
+	}
+
+	if got := rsp.Answers[0].Type; got != dns.DNAME {
+		t.Errorf("expected type DNAME, got %s", got)
+	}
+
+	for i, exp := range []dns.Resource{
+		{
+			Name: name("example", "com"),
+			Data: name("example", "net"),
+		},
+		{
+			Name: name("www", "example", "com"),
+			Data: name("www", "example", "net"),
+		},
+	} {
+		t.Run(fmt.Sprintf("answer %d", i), func(t *testing.T) {
+			got := rsp.Answers[i]
+			checkNameAndData(t, exp, got)
+		})
+	}
+}
+
+func TestWriteDNAMEIsUncompressed(t *testing.T) {
+	msg := dns.Message{
+		Answers: []dns.Resource{
+			{
+				Name:  name("example", "net"),
+				Type:  dns.A,
+				Class: dns.IN,
+				Data:  net.ParseIP("192.0.2.1"),
+			},
+			{
+				Name:  name("example", "com"),
+				Type:  dns.DNAME,
+				Class: dns.IN,
+				Data:  name("example", "net"),
+			},
+		},
+	}
+	buf, err := msg.WriteTo(nil)
+	if err != nil {
+		t.Fatalf("unexpected error writing: %s", err)
+	}
+
+	// header + first answer + owner, type, class, ttl and length of the
+	// second answer:
+	rdata := buf[12+(13+10+4)+(13+10):]
+	if !slices.Equal(rdata, []byte("\x07example\x03net\x00")) {
+		t.Errorf("expected uncompressed DNAME target, got %q", rdata)
+	}
+}
+
+func TestRoundTripPTR(t *testing.T) {
+	ptr := dns.Resource{
+		Name:  name("1", "2", "0", "192", "in-addr", "arpa"),
+		Type:  dns.PTR,
+		Class: dns.IN,
+		Data:  name("www", "example", "com"),
+	}
+	buf, err := dns.Message{Answers: []dns.Resource{ptr}}.WriteTo(nil)
+	if err != nil {
+		t.Fatalf("unexpected error writing: %s", err)
+	}
+	rsp, err := dns.ParseMessage(buf)
+	if err != nil {
+		t.Fatalf("unexpected error parsing: %s", err)
+	}
+	if len(rsp.Answers) != 1 {
+		t.Fatalf("expected 1 answer, got %d", len(rsp.Answers))
+	}
+	checkNameAndData(t, ptr, rsp.Answers[0])
+}
+
 func checkNameAndData(
 	t *testing.T,
 	exp dns.Resource,
@@ -959,6 +1076,7 @@ var allValidTestMessages = map[string][]byte{
 	"googleMXResponse":         googleMXResponse,
 	"googleRootAResponse":      googleRootAResponse,
 	"googleSOAResponse":        googleSOAResponse,
+	"dnameResponse":            dnameResponse,
 }
 
 func TestRoundTripMessage(t *testing.T) {
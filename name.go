@@ -21,6 +21,9 @@ var ErrLabelTooLong = errors.New("no label may be longer than 63 bytes")
 var ErrNameTooLong = errors.New("a name may not exceed 255 bytes")
 
 func ParseName(hostname string) (Name, error) {
+	if hostname == "." {
+		return Name{}, nil
+	}
 	labels := strings.Split(hostname, ".")
 	name := make(Name, len(labels))
 	totalLen := 0
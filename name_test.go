@@ -15,6 +15,7 @@ func TestParseValidNames(t *testing.T) {
 		{"google.com", name("google", "com")},
 		{"google.com.", name("google", "com")},
 		{"", name()},
+		{".", name()},
 		{
 			strings.Repeat("1234567890", 6) + "123.com",
 			name(dns.Label(strings.Repeat("1234567890", 6)+"123"), "com"),
@@ -25,6 +25,8 @@ func _() {
 	_ = x[MX-15]
 	_ = x[TXT-16]
 	_ = x[AAAA-28]
+	_ = x[DNAME-39]
+	_ = x[OPT-41]
 	_ = x[AXFR-252]
 	_ = x[MAILB-253]
 	_ = x[MAILA-254]
@@ -34,12 +36,14 @@ func _() {
 const (
 	_QueryType_name_0 = "ANSMDMFCNAMESOAMBMGMRNULLWKSPTRHINFOMINFOMXTXT"
 	_QueryType_name_1 = "AAAA"
-	_QueryType_name_2 = "AXFRMAILBMAILAANY_QUERY"
+	_QueryType_name_2 = "DNAME"
+	_QueryType_name_3 = "OPT"
+	_QueryType_name_4 = "AXFRMAILBMAILAANY_QUERY"
 )
 
 var (
 	_QueryType_index_0 = [...]uint8{0, 1, 3, 5, 7, 12, 15, 17, 19, 21, 25, 28, 31, 36, 41, 43, 46}
-	_QueryType_index_2 = [...]uint8{0, 4, 9, 14, 23}
+	_QueryType_index_4 = [...]uint8{0, 4, 9, 14, 23}
 )
 
 func (i QueryType) String() string {
@@ -49,9 +53,13 @@ func (i QueryType) String() string {
 		return _QueryType_name_0[_QueryType_index_0[i]:_QueryType_index_0[i+1]]
 	case i == 28:
 		return _QueryType_name_1
+	case i == 39:
+		return _QueryType_name_2
+	case i == 41:
+		return _QueryType_name_3
 	case 252 <= i && i <= 255:
 		i -= 252
-		return _QueryType_name_2[_QueryType_index_2[i]:_QueryType_index_2[i+1]]
+		return _QueryType_name_4[_QueryType_index_4[i]:_QueryType_index_4[i+1]]
 	default:
 		return "QueryType(" + strconv.FormatInt(int64(i), 10) + ")"
 	}
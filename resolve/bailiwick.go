@@ -0,0 +1,118 @@
+package resolve
+
+import (
+	"dns"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+)
+
+// ErrBogusReferral means that a server tried to refer us to servers that
+// aren't closer to the name that we're looking for.
+var ErrBogusReferral = errors.New("bogus referral")
+
+// inBailiwick checks whether name is in zone, or any of zone's subdomains.
+func inBailiwick(name, zone dns.Name) bool {
+	return name.Equal(zone) || name.IsSubdomainOf(zone)
+}
+
+// zoneString formats a zone name, including the root, for messages.
+func zoneString(zone dns.Name) string {
+	if len(zone) == 0 {
+		return "."
+	}
+	return zone.String()
+}
+
+// scrub removes any records from a response that the servers for zone have
+// no business telling us about.  Those are the records that could be used
+// to poison our cache with data for unrelated names.
+func scrub(logger *slog.Logger, zone dns.Name, rsp dns.Message) dns.Message {
+	rsp.Answers = scrubSection(logger, zone, rsp.Answers)
+	rsp.Authorities = scrubSection(logger, zone, rsp.Authorities)
+	rsp.Additional = scrubSection(logger, zone, rsp.Additional)
+	return rsp
+}
+
+func scrubSection(logger *slog.Logger, zone dns.Name, resources []dns.Resource) []dns.Resource {
+	var scrubbed []dns.Resource
+	for _, resource := range resources {
+		if inBailiwick(resource.Name, zone) {
+			scrubbed = append(scrubbed, resource)
+		} else {
+			logger.Debug("scrubbed out-of-bailiwick record",
+				slog.String("name", resource.Name.String()), slog.String("type", resource.Type.String()), zoneAttr(zone))
+		}
+	}
+	return scrubbed
+}
+
+// findReferral checks whether a response from a server for zone refers us
+// to the servers for a child zone that's closer to name.  If it does, the
+// child zone is returned along with its name servers and any glue
+// addresses for them.
+//
+// Referrals anywhere other than downwards towards name are rejected, as is
+// glue for servers outside of zone, since we can't trust the server to
+// tell us about those.
+func findReferral(logger *slog.Logger, zone, name dns.Name, rsp dns.Message) (dns.Name, []NameServer, error) {
+	var child dns.Name
+	var servers []NameServer
+	for _, authority := range rsp.Authorities {
+		if authority.Type != dns.NS {
+			continue
+		}
+
+		authorityName, ok := authority.Data.(dns.Name)
+		if !ok {
+			continue
+		}
+
+		if servers == nil {
+			child = authority.Name
+			if child.Equal(zone) && rsp.Flags.Authoritative() {
+				// just telling us about its own servers, not a referral
+				return nil, nil, nil
+			}
+			if !child.IsSubdomainOf(zone) {
+				return nil, nil, fmt.Errorf("%w: upward referral from %s to %s",
+					ErrBogusReferral, zoneString(zone), zoneString(child))
+			}
+			if !inBailiwick(name, child) {
+				return nil, nil, fmt.Errorf("%w: sideways referral from %s to %s for %s",
+					ErrBogusReferral, zoneString(zone), child, name)
+			}
+		} else if !authority.Name.Equal(child) {
+			// we can only follow one referral
+			continue
+		}
+
+		server := NameServer{Name: authorityName}
+		if inBailiwick(authorityName, zone) {
+			server.Addrs = findGlue(authorityName, rsp)
+		}
+		logger.Debug("referral",
+			zoneAttr(zone), slog.String("child", zoneString(child)), slog.String("ns", server.String()))
+		servers = append(servers, server)
+	}
+	return child, servers, nil
+}
+
+func findGlue(name dns.Name, rsp dns.Message) []net.IP {
+	var addrs []net.IP
+	for _, additional := range rsp.Additional {
+		if additional.Type != dns.A && additional.Type != dns.AAAA {
+			continue
+		}
+
+		if !name.Equal(additional.Name) {
+			continue
+		}
+
+		if ip, ok := additional.Data.(net.IP); ok {
+			addrs = append(addrs, ip)
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,105 @@
+package resolve_test
+
+import (
+	"context"
+	"dns"
+	"dns/resolve"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestBogusReferrals(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		referral dns.Resource
+	}{
+		{"upward", rr(".", dns.NS, "a.root.")},
+		{"same level", rr("com.", dns.NS, "ns.com.")},
+		{"sideways", rr("example.net.", dns.NS, "ns.com.")},
+		{"unrelated child", rr("other.com.", dns.NS, "ns.com.")},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			n := testNet()
+			n["10.0.1.1"] = func(q dns.Question) dns.Message {
+				return dns.Message{
+					Authorities: []dns.Resource{test.referral},
+					Additional:  []dns.Resource{rr("ns.com.", dns.A, "10.0.1.1")},
+				}
+			}
+			r := newTestResolver(n)
+
+			_, err := r.Resolve(context.Background(), question("www.example.com", dns.A))
+			if !errors.Is(err, resolve.ErrBogusReferral) {
+				t.Fatalf("expected a bogus referral error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestOutOfBailiwickGlueIsIgnored(t *testing.T) {
+	n := testNet()
+	n["10.0.1.1"] = zone(
+		rr("com.", dns.NS, "ns.com."),
+		rr("example.com.", dns.NS, "ns.example.net."),
+		// com can't tell us where the servers in net are:
+		rr("ns.example.net.", dns.A, "10.6.6.6"),
+	)
+	n["10.6.6.6"] = zone(
+		rr("example.com.", dns.NS, "ns.example.net."),
+		rr("www.example.com.", dns.A, "10.6.6.6"),
+	)
+	n["10.0.0.1"] = zone(
+		rr(".", dns.NS, "a.root."),
+		rr("com.", dns.NS, "ns.com."),
+		rr("ns.com.", dns.A, "10.0.1.1"),
+		rr("net.", dns.NS, "ns.net."),
+		rr("ns.net.", dns.A, "10.0.3.1"),
+	)
+	n["10.0.3.1"] = zone(
+		rr("net.", dns.NS, "ns.net."),
+		rr("ns.example.net.", dns.A, "10.0.2.1"),
+	)
+	var queried []string
+	r := newTestResolver(n.record(&queried))
+
+	rsp, err := r.Resolve(context.Background(), question("www.example.com", dns.A))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(queried, "10.6.6.6") {
+		t.Errorf("expected out-of-bailiwick glue to be ignored, but queried %s", queried)
+	}
+	if len(rsp.Answers) != 1 || rsp.Answers[0].Data.(net.IP).String() != "192.0.2.1" {
+		t.Errorf("expected the answer from the real server, got %v", rsp.Answers)
+	}
+}
+
+func TestOutOfBailiwickRecordsAreScrubbed(t *testing.T) {
+	n := testNet()
+	example := n["10.0.2.1"]
+	n["10.0.2.1"] = func(q dns.Question) dns.Message {
+		rsp := example(q)
+		rsp.Answers = append(rsp.Answers, rr("www.bank.test.", dns.A, "10.6.6.6"))
+		rsp.Authorities = append(rsp.Authorities, rr("bank.test.", dns.NS, "ns.example.com."))
+		rsp.Additional = append(rsp.Additional, rr("ns.bank.test.", dns.A, "10.6.6.6"))
+		return rsp
+	}
+	r := newTestResolver(n)
+
+	rsp, err := r.Resolve(context.Background(), question("www.example.com", dns.A))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, section := range [][]dns.Resource{rsp.Answers, rsp.Authorities, rsp.Additional} {
+		for _, resource := range section {
+			if resource.Name.IsSubdomainOf(name("test")) {
+				t.Errorf("expected %s/%s to be scrubbed", resource.Name, resource.Type)
+			}
+		}
+	}
+	if len(rsp.Answers) != 1 {
+		t.Errorf("expected the real answer to be kept, got %v", rsp.Answers)
+	}
+}
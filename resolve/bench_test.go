@@ -0,0 +1,86 @@
+package resolve_test
+
+import (
+	"dns"
+	"dns/resolve"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"testing"
+	"time"
+)
+
+// BenchmarkCachePolicies looks up names with a skewed (zipf) popularity,
+// like real traffic, in a cache that can only hold some of them.  It
+// reports the hit rate of each policy as well as its speed.
+func BenchmarkCachePolicies(b *testing.B) {
+	const names = 10_000
+	questions := make([]dns.Question, names)
+	for i := range questions {
+		questions[i] = question(fmt.Sprintf("host%d.test", i), dns.A)
+	}
+
+	for _, policy := range []struct {
+		name string
+		new  func() resolve.EvictionPolicy
+	}{
+		{"LRU", func() resolve.EvictionPolicy { return resolve.NewLRU() }},
+		{"FIFO", func() resolve.EvictionPolicy { return resolve.NewFIFO() }},
+	} {
+		b.Run(policy.name, func(b *testing.B) {
+			c := resolve.NewCache()
+			c.Shards = 1
+			c.MaxEntries = names / 10
+			c.NewPolicy = policy.new
+			zipf := rand.NewZipf(rand.New(rand.NewPCG(1, 2)), 1.1, 1, names-1)
+
+			var hits, lookups int
+			for b.Loop() {
+				q := questions[zipf.Uint64()]
+				lookups++
+				if _, ok := c.Get(q); ok {
+					hits++
+					continue
+				}
+				c.Put([]dns.Resource{
+					{Name: q.Name, Type: dns.A, Class: dns.IN, TTL: time.Hour, Data: net.IPv4(192, 0, 2, 1)},
+				}, resolve.TrustAnswer)
+			}
+			b.ReportMetric(float64(hits)/float64(lookups), "hits/op")
+		})
+	}
+}
+
+// BenchmarkCacheParallel looks up names from lots of goroutines at once,
+// as cmd/server does, to compare how well different numbers of shards
+// cope with contention.
+func BenchmarkCacheParallel(b *testing.B) {
+	const names = 10_000
+	questions := make([]dns.Question, names)
+	for i := range questions {
+		questions[i] = question(fmt.Sprintf("host%d.test", i), dns.A)
+	}
+
+	for _, shards := range []int{1, 8, 64} {
+		b.Run(fmt.Sprintf("%d shards", shards), func(b *testing.B) {
+			c := resolve.NewCache()
+			c.Shards = shards
+			c.MaxEntries = names / 2
+			b.SetParallelism(16)
+			b.RunParallel(func(pb *testing.PB) {
+				rnd := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+				for pb.Next() {
+					q := questions[rnd.IntN(names)]
+					if _, ok := c.Get(q); ok {
+						continue
+					}
+					c.Put([]dns.Resource{
+						{Name: q.Name, Type: dns.A, Class: dns.IN, TTL: time.Hour, Data: net.IPv4(192, 0, 2, 1)},
+					}, resolve.TrustAnswer)
+				}
+			})
+			stats := c.Stats()
+			b.ReportMetric(float64(stats.LockWait)/float64(stats.Locks), "ns-lock-wait/lock")
+		})
+	}
+}
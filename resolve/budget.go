@@ -0,0 +1,124 @@
+package resolve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Budget limits how much work may be done to resolve a single question,
+// including any name servers that need to be looked up along the way.
+// This protects us, and the servers we talk to, from delegations that
+// loop or fan out to huge numbers of names (eg, NXNS attacks).
+//
+// Zero values are replaced with defaults.
+type Budget struct {
+	// MaxReferrals limits how many referrals we follow.
+	MaxReferrals int
+
+	// MaxQueries limits how many queries we send to servers.
+	MaxQueries int
+
+	// MaxNSLookups limits how many name servers we look up because
+	// referrals didn't include their addresses.
+	MaxNSLookups int
+
+	// MaxTime limits how long resolution takes.
+	MaxTime time.Duration
+}
+
+var defaultBudget = Budget{
+	MaxReferrals: 40,
+	MaxQueries:   100,
+	MaxNSLookups: 16,
+	MaxTime:      10 * time.Second,
+}
+
+func (b Budget) withDefaults() Budget {
+	if b.MaxReferrals == 0 {
+		b.MaxReferrals = defaultBudget.MaxReferrals
+	}
+	if b.MaxQueries == 0 {
+		b.MaxQueries = defaultBudget.MaxQueries
+	}
+	if b.MaxNSLookups == 0 {
+		b.MaxNSLookups = defaultBudget.MaxNSLookups
+	}
+	if b.MaxTime == 0 {
+		b.MaxTime = defaultBudget.MaxTime
+	}
+	return b
+}
+
+var ErrBudgetExceeded = errors.New("resolution budget exceeded")
+
+// BudgetExceededError says which part of a Budget ran out.
+type BudgetExceededError struct {
+	// Limit is what ran out: "referrals", "queries", "name server lookups"
+	// or "time".
+	Limit string
+	// Max is the value of the limit in the Budget.
+	Max any
+}
+
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf("%s: %s (max %v)", ErrBudgetExceeded, e.Limit, e.Max)
+}
+
+func (e *BudgetExceededError) Is(target error) bool {
+	return target == ErrBudgetExceeded
+}
+
+// budget keeps track of what has been spent while resolving one question.
+// Name server lookups are shared with other resolutions, and carry on
+// spending it after a resolution that's given up has returned, so it's
+// safe for concurrent use.
+type budget struct {
+	limits   Budget
+	deadline time.Time
+
+	mutex     sync.Mutex
+	referrals int
+	queries   int
+	nsLookups int
+}
+
+func newBudget(limits Budget) *budget {
+	limits = limits.withDefaults()
+	return &budget{limits: limits, deadline: time.Now().Add(limits.MaxTime)}
+}
+
+// withDeadline returns a context that's cancelled when the budget's time
+// runs out, with a BudgetExceededError as its cause.
+func (b *budget) withDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithDeadlineCause(ctx, b.deadline,
+		&BudgetExceededError{Limit: "time", Max: b.limits.MaxTime})
+}
+
+func (b *budget) referral() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return spend(&b.referrals, b.limits.MaxReferrals, "referrals")
+}
+
+func (b *budget) query() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return spend(&b.queries, b.limits.MaxQueries, "queries")
+}
+
+func (b *budget) nsLookup() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return spend(&b.nsLookups, b.limits.MaxNSLookups, "name server lookups")
+}
+
+func spend(spent *int, max int, limit string) error {
+	if *spent >= max {
+		return &BudgetExceededError{Limit: limit, Max: max}
+	}
+	*spent++
+	return nil
+}
@@ -0,0 +1,96 @@
+package resolve_test
+
+import (
+	"context"
+	"dns"
+	"dns/resolve"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDelegationLoopExhaustsBudget(t *testing.T) {
+	n := fakeNet{
+		"10.0.0.1": zone(
+			rr(".", dns.NS, "a.root."),
+			// each zone's servers are only in the other zone:
+			rr("a.test.", dns.NS, "ns.b.test."),
+			rr("b.test.", dns.NS, "ns.a.test."),
+		),
+	}
+	r := newTestResolver(n)
+
+	_, err := r.Resolve(context.Background(), question("www.a.test", dns.A))
+	if !errors.Is(err, resolve.ErrBudgetExceeded) {
+		t.Fatalf("expected the budget to be exceeded, got %v", err)
+	}
+}
+
+func TestNXNSExhaustsBudget(t *testing.T) {
+	// a referral to lots of name servers without glue, that don't exist:
+	referral := []dns.Resource{rr(".", dns.NS, "a.root.")}
+	for i := range 100 {
+		referral = append(referral,
+			rr("victim.test.", dns.NS, fmt.Sprintf("ns%d.target.test.", i)))
+	}
+	n := fakeNet{"10.0.0.1": zone(referral...)}
+	var queried []string
+	r := newTestResolver(n.record(&queried))
+	r.Budget = resolve.Budget{MaxNSLookups: 5}
+
+	_, err := r.Resolve(context.Background(), question("www.victim.test", dns.A))
+	var budgetErr *resolve.BudgetExceededError
+	if !errors.As(err, &budgetErr) {
+		t.Fatalf("expected the budget to be exceeded, got %v", err)
+	}
+	if budgetErr.Limit != "name server lookups" {
+		t.Errorf("expected to run out of name server lookups, got %s", budgetErr.Limit)
+	}
+	// the priming query, the original query minimised to test. and then
+	// victim.test., and A and AAAA for each name server that we were
+	// allowed to look up:
+	if len(queried) > 3+5*2 {
+		t.Errorf("expected at most 13 queries, got %d", len(queried))
+	}
+}
+
+func TestBudgetLimits(t *testing.T) {
+	for _, test := range []struct {
+		budget resolve.Budget
+		limit  string
+	}{
+		{resolve.Budget{MaxReferrals: 1}, "referrals"},
+		{resolve.Budget{MaxQueries: 2}, "queries"},
+	} {
+		t.Run(test.limit, func(t *testing.T) {
+			r := newTestResolver(testNet())
+			r.Budget = test.budget
+
+			_, err := r.Resolve(context.Background(), question("www.example.com", dns.A))
+			var budgetErr *resolve.BudgetExceededError
+			if !errors.As(err, &budgetErr) {
+				t.Fatalf("expected the budget to be exceeded, got %v", err)
+			}
+			if budgetErr.Limit != test.limit {
+				t.Errorf("expected to run out of %s, got %s", test.limit, budgetErr.Limit)
+			}
+		})
+	}
+}
+
+func TestBudgetTime(t *testing.T) {
+	n := testNet()
+	n["10.0.2.1"] = nil // never responds
+	r := newTestResolver(n)
+	r.Budget = resolve.Budget{MaxTime: 10 * time.Millisecond}
+
+	_, err := r.Resolve(context.Background(), question("www.example.com", dns.A))
+	var budgetErr *resolve.BudgetExceededError
+	if !errors.As(err, &budgetErr) {
+		t.Fatalf("expected the budget to be exceeded, got %v", err)
+	}
+	if budgetErr.Limit != "time" {
+		t.Errorf("expected to run out of time, got %s", budgetErr.Limit)
+	}
+}
@@ -1,49 +1,797 @@
 package resolve
 
 import (
+	"cmp"
 	"dns"
+	"fmt"
+	"hash/maphash"
+	"io"
+	"net"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-type cacheKey struct {
+// CacheKey identifies an entry in a Cache.  It can be compared, and used
+// as a map key.
+type CacheKey struct {
 	name  string
 	typ   dns.QueryType
 	class dns.QueryClass
 }
 
-func newCacheKey(q dns.Question) cacheKey {
-	return cacheKey{
-		name:  string(q.Name.String()),
+func newCacheKey(q dns.Question) CacheKey {
+	return CacheKey{
+		name:  keyName(q.Name),
 		typ:   q.Type,
 		class: q.Class,
 	}
 }
 
+// keyName makes a name into a string that's the same for every name that
+// it's Equal to, by lower-casing it, since the case of names doesn't
+// matter in DNS.  The labels are prefixed with their lengths, as on the
+// wire, so that a label with a dot in it can't pass for two.
+func keyName(name dns.Name) string {
+	var key []byte
+	for _, label := range name {
+		key = append(key, byte(len(label)))
+		for _, c := range []byte(label) {
+			if 'A' <= c && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			key = append(key, c)
+		}
+	}
+	return string(key)
+}
+
+// Trust ranks how much we believe cached data, from RFC 2181 section
+// 5.4.1.  Data is never replaced by data that we trust less, and data
+// that's only trusted as much as glue is never used in answers.
+type Trust int
+
+const (
+	// TrustAdditional is for data from the additional section, other
+	// than glue.
+	TrustAdditional Trust = iota
+	// TrustGlue is for the name servers and their addresses in
+	// referrals.
+	TrustGlue
+	// TrustNonAuthoritativeAnswer is for the answer section of responses
+	// that aren't authoritative.
+	TrustNonAuthoritativeAnswer
+	// TrustAuthority is for the authority section of authoritative
+	// responses.
+	TrustAuthority
+	// TrustAnswer is for the answer section of authoritative responses.
+	TrustAnswer
+)
+
+func (t Trust) String() string {
+	switch t {
+	case TrustAdditional:
+		return "additional"
+	case TrustGlue:
+		return "glue"
+	case TrustNonAuthoritativeAnswer:
+		return "non-authoritative answer"
+	case TrustAuthority:
+		return "authority"
+	case TrustAnswer:
+		return "answer"
+	default:
+		return fmt.Sprintf("Trust(%d)", int(t))
+	}
+}
+
+// nxDomainType is used in the keys of entries for names that don't
+// exist, since that applies to every type.
+const nxDomainType dns.QueryType = 0
+
+type cacheEntry struct {
+	name dns.Name
+
+	// resources have their TTLs clamped, but not yet reduced by the
+	// time they've spent in the cache
+	resources []dns.Resource
+
+	trust Trust
+
+	// negative entries hold the SOA record that proves that the name,
+	// or the type for the name, doesn't exist
+	negative bool
+	rcode    dns.ResponseCode
+
+	stored  time.Time
+	expires time.Time
+
+	// hits counts how often the entry has been read since it was stored
+	hits int
+}
+
+// freshness describes the cache entries behind an answer: the fraction of
+// the TTL that's left of the one that will expire soonest, and how often
+// that one has been used.
+type freshness struct {
+	left float64
+	hits int
+}
+
+// Cache holds RRsets until their TTLs run out, along with how much we
+// trust them.
+//
+// It also remembers names and types that don't exist, as in RFC 2308.
+//
+// Entries are spread over several shards, each with its own lock, so that
+// lots of goroutines can use the cache at once without waiting for each
+// other much.  The fields must be set before the cache is first used.
+//
+// Expired entries are removed when they're next read, and each shard is
+// swept for any that never are when things are stored in it, at most once
+// every sweepInterval, so that they don't pile up or take the place of
+// live entries for long.
 type Cache struct {
-	cache map[cacheKey][]dns.Resource
-	mutex *sync.Mutex
+	// MinTTL and MaxTTL clamp the TTLs of resources put in the cache.
+	// Zero means no limit.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+
+	// MaxNegativeTTL limits how long we remember that something doesn't
+	// exist.  Zero means no limit beyond MaxTTL.
+	MaxNegativeTTL time.Duration
+
+	// StaleWindow is how long to keep entries after they expire, in case
+	// we can't get fresh answers from the authorities and have to serve
+	// stale ones instead (RFC 8767).  Zero means entries are removed as
+	// soon as they expire.
+	StaleWindow time.Duration
+
+	// StaleTTL is the TTL given to stale answers.  Defaults to 30s.
+	StaleTTL time.Duration
+
+	// MaxEntries limits how many entries the cache holds.  It's divided
+	// evenly between the shards, rounding up, and when a shard is full
+	// its eviction policy chooses what to evict.  Zero means no limit.
+	MaxEntries int
+
+	// NewPolicy creates the eviction policy for each shard.  Defaults to
+	// NewLRU.
+	NewPolicy func() EvictionPolicy
+
+	// Shards is how many shards to split the cache into.  Defaults to 64.
+	Shards int
+
+	// Now tells the cache what time it is.  Defaults to time.Now.
+	Now func() time.Time
+
+	init   sync.Once
+	seed   maphash.Seed
+	shards []cacheShard
+	stats  cacheStats
+}
+
+const defaultShards = 64
+
+// sweepInterval is how often each shard is swept for expired entries.
+const sweepInterval = time.Minute
+
+// cacheShard holds the entries whose keys hash to it.
+type cacheShard struct {
+	mutex      sync.Mutex
+	entries    map[CacheKey]cacheEntry
+	policy     EvictionPolicy
+	maxEntries int
+	nextSweep  time.Time
+}
+
+// setup fills in the defaults and makes the shards, the first time that
+// the cache is used, so that it doesn't have to come from NewCache.  It
+// has to be called before Now is.
+func (c *Cache) setup() {
+	c.init.Do(func() {
+		if c.Now == nil {
+			c.Now = time.Now
+		}
+		if c.NewPolicy == nil {
+			c.NewPolicy = func() EvictionPolicy { return NewLRU() }
+		}
+		n := c.Shards
+		if n <= 0 {
+			n = defaultShards
+		}
+		c.seed = maphash.MakeSeed()
+		c.shards = make([]cacheShard, n)
+		for i := range c.shards {
+			c.shards[i].entries = make(map[CacheKey]cacheEntry)
+			c.shards[i].policy = c.NewPolicy()
+			c.shards[i].maxEntries = (c.MaxEntries + n - 1) / n
+		}
+	})
+}
+
+// shard finds the shard for a key.
+func (c *Cache) shard(key CacheKey) *cacheShard {
+	c.setup()
+	return &c.shards[maphash.Comparable(c.seed, key)%uint64(len(c.shards))]
+}
+
+// allShards returns every shard.
+func (c *Cache) allShards() []cacheShard {
+	c.setup()
+	return c.shards
+}
+
+// CacheStats counts what a Cache has been doing since it was created.
+type CacheStats struct {
+	// Hits and Misses count calls to Get.  A hit might have followed
+	// CNAMEs through the cache.
+	Hits   uint64
+	Misses uint64
+	// NegativeHits and NegativeMisses count calls to GetNegative.
+	NegativeHits   uint64
+	NegativeMisses uint64
+	// StaleHits counts calls to GetStale that found an answer.
+	StaleHits uint64
+
+	// Inserts counts entries stored, including replacements.
+	Inserts uint64
+	// Evictions counts entries removed to keep within MaxEntries.
+	Evictions uint64
+	// Expirations counts entries removed because their TTLs ran out.
+	Expirations uint64
+
+	// Size is how many entries are in the cache, including any that
+	// have expired but haven't been removed yet.
+	Size int
+
+	// Locks counts how often a shard of the cache was locked, and
+	// LockWait is the total time spent waiting for the locks.
+	Locks    uint64
+	LockWait time.Duration
+}
+
+type cacheStats struct {
+	hits, misses                 atomic.Uint64
+	negativeHits, negativeMisses atomic.Uint64
+	staleHits                    atomic.Uint64
+	inserts                      atomic.Uint64
+	evictions                    atomic.Uint64
+	expirations                  atomic.Uint64
+	locks                        atomic.Uint64
+	lockWait                     atomic.Int64
+}
+
+// Stats returns the cache's counters.
+func (c *Cache) Stats() CacheStats {
+	var size int
+	for i := range c.allShards() {
+		shard := &c.shards[i]
+		c.lock(shard)
+		size += len(shard.entries)
+		shard.mutex.Unlock()
+	}
+
+	return CacheStats{
+		Hits:           c.stats.hits.Load(),
+		Misses:         c.stats.misses.Load(),
+		NegativeHits:   c.stats.negativeHits.Load(),
+		NegativeMisses: c.stats.negativeMisses.Load(),
+		StaleHits:      c.stats.staleHits.Load(),
+		Inserts:        c.stats.inserts.Load(),
+		Evictions:      c.stats.evictions.Load(),
+		Expirations:    c.stats.expirations.Load(),
+		Size:           size,
+		Locks:          c.stats.locks.Load(),
+		LockWait:       time.Duration(c.stats.lockWait.Load()),
+	}
+}
+
+// lock locks a shard of the cache, timing how long it takes.  This uses
+// the real clock rather than Now, which might be fake.
+func (c *Cache) lock(shard *cacheShard) {
+	start := time.Now()
+	shard.mutex.Lock()
+	c.stats.lockWait.Add(int64(time.Since(start)))
+	c.stats.locks.Add(1)
+}
+
+// Get answers the question from the cache, following any CNAMEs that
+// are cached for it, with the CNAMEs first.  Only data that we trust
+// enough to give out in answers is used.  The TTLs are reduced by the
+// time that they've been in the cache.
+func (c *Cache) Get(q dns.Question) ([]dns.Resource, bool) {
+	answers, _, ok := c.lookup(q)
+	return answers, ok
+}
+
+// lookup is Get, but also says how fresh the answer is.
+func (c *Cache) lookup(q dns.Question) ([]dns.Resource, freshness, bool) {
+	answers, fresh, ok := c.answer(q, readFresh)
+	if ok {
+		c.stats.hits.Add(1)
+	} else {
+		c.stats.misses.Add(1)
+	}
+	return answers, fresh, ok
+}
+
+// GetStale is like Get, but also uses entries that have expired within
+// the StaleWindow, giving them a TTL of StaleTTL.  It's for when we can't
+// get a fresh answer.
+func (c *Cache) GetStale(q dns.Question) ([]dns.Resource, bool) {
+	answers, _, ok := c.answer(q, readStale)
+	if ok {
+		c.stats.staleHits.Add(1)
+	}
+	return answers, ok
+}
+
+func (c *Cache) answer(q dns.Question, mode readMode) ([]dns.Resource, freshness, bool) {
+	var answers []dns.Resource
+	fresh := freshness{left: 1}
+	name := q.Name
+	for range maxChainLength + 1 {
+		if entry, ok := c.getAnswerEntry(name, q.Type, q.Class, mode); ok {
+			fresh = c.fresher(fresh, entry)
+			return append(answers, entry.resources...), fresh, true
+		}
+		if q.Type == dns.CNAME {
+			break
+		}
+		entry, ok := c.getAnswerEntry(name, dns.CNAME, q.Class, mode)
+		if !ok {
+			break
+		}
+		target, ok := entry.resources[0].Data.(dns.Name)
+		if !ok {
+			break
+		}
+		fresh = c.fresher(fresh, entry)
+		answers = append(answers, entry.resources[0])
+		name = target
+	}
+	return nil, freshness{}, false
+}
+
+func (c *Cache) getAnswerEntry(name dns.Name, typ dns.QueryType, class dns.QueryClass, mode readMode) (cacheEntry, bool) {
+	entry, ok := c.get(newCacheKey(dns.Question{Name: name, Type: typ, Class: class}), mode)
+	if !ok || entry.negative || entry.trust < TrustNonAuthoritativeAnswer {
+		return cacheEntry{}, false
+	}
+	return entry, true
+}
+
+// fresher returns whichever is the least fresh out of fresh and entry.
+func (c *Cache) fresher(fresh freshness, entry cacheEntry) freshness {
+	ttl := entry.expires.Sub(entry.stored)
+	left := float64(entry.expires.Sub(c.Now())) / float64(ttl)
+	if left < fresh.left {
+		return freshness{left: left, hits: entry.hits}
+	}
+	return fresh
+}
+
+// GetRRset finds the unexpired RRset for the name, type and class, if we
+// trust it at least as much as minTrust.  The TTLs are reduced by the time
+// that it's been in the cache.  It doesn't count towards the stats.
+func (c *Cache) GetRRset(name dns.Name, typ dns.QueryType, class dns.QueryClass, minTrust Trust) ([]dns.Resource, bool) {
+	return c.getRRset(name, typ, class, minTrust, readFresh)
+}
+
+func (c *Cache) getRRset(name dns.Name, typ dns.QueryType, class dns.QueryClass, minTrust Trust, mode readMode) ([]dns.Resource, bool) {
+	entry, ok := c.get(newCacheKey(dns.Question{Name: name, Type: typ, Class: class}), mode)
+	if !ok || entry.negative || entry.trust < minTrust {
+		return nil, false
+	}
+	return entry.resources, true
+}
+
+// GetNegative checks whether the question is known to have no answers,
+// either because the name doesn't exist (dns.NameError) or because it has
+// no resources of that type (dns.NoError).  The SOA record that proved it
+// is returned too, with its TTL reduced by the time it's been cached.
+func (c *Cache) GetNegative(q dns.Question) (dns.ResponseCode, dns.Resource, bool) {
+	rcode, soa, ok := c.negative(q, readFresh)
+	if ok {
+		c.stats.negativeHits.Add(1)
+	} else {
+		c.stats.negativeMisses.Add(1)
+	}
+	return rcode, soa, ok
 }
 
-// TODO: need a strategy for handling TTLs
-// TODO: track some basic stats on cache hits / misses / size
-// TODO: stats on cache locking performance?
+// GetStaleNegative is like GetNegative, but also uses entries that have
+// expired within the StaleWindow, as GetStale does.
+func (c *Cache) GetStaleNegative(q dns.Question) (dns.ResponseCode, dns.Resource, bool) {
+	rcode, soa, ok := c.negative(q, readStale)
+	if ok {
+		c.stats.staleHits.Add(1)
+	}
+	return rcode, soa, ok
+}
+
+func (c *Cache) negative(q dns.Question, mode readMode) (dns.ResponseCode, dns.Resource, bool) {
+	key := newCacheKey(q)
+	entry, ok := c.get(key, mode)
+	if !ok || !entry.negative {
+		key.typ = nxDomainType
+		entry, ok = c.get(key, mode)
+	}
+	if !ok || !entry.negative {
+		return 0, dns.Resource{}, false
+	}
+	return entry.rcode, entry.resources[0], true
+}
+
+// readMode says which entries get finds, and what it does to them.
+type readMode int
+
+// readFresh finds unexpired entries, and counts them as used.
+const readFresh readMode = 0
+
+const (
+	// readStale also finds entries that have expired within the
+	// StaleWindow, with TTLs of StaleTTL.
+	readStale readMode = 1 << iota
+	// readPeek leaves the entries as they were, so that looking doesn't
+	// make them any more popular, or any less likely to be evicted.
+	readPeek
+)
+
+// get finds an unexpired entry, with TTLs reduced by the time it's been
+// cached, or an expired one, if the mode says so.
+func (c *Cache) get(key CacheKey, mode readMode) (cacheEntry, bool) {
+	shard := c.shard(key)
+	now := c.Now()
+
+	c.lock(shard)
+	defer shard.mutex.Unlock()
+	entry, ok := shard.entries[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	if !now.Before(entry.expires.Add(c.StaleWindow)) {
+		if mode&readPeek != 0 {
+			return cacheEntry{}, false
+		}
+		delete(shard.entries, key)
+		shard.policy.Remove(key)
+		c.stats.expirations.Add(1)
+		return cacheEntry{}, false
+	}
+	expired := !now.Before(entry.expires)
+	if expired && mode&readStale == 0 {
+		return cacheEntry{}, false
+	}
+	if mode&readPeek == 0 {
+		shard.policy.Touch(key)
+		entry.hits++
+		shard.entries[key] = entry
+	}
+
+	elapsed := now.Sub(entry.stored)
+	entry.resources = slices.Clone(entry.resources)
+	for i := range entry.resources {
+		if expired {
+			entry.resources[i].TTL = c.staleTTL()
+		} else {
+			entry.resources[i].TTL = ceilSeconds(entry.resources[i].TTL - elapsed)
+		}
+	}
+	return entry, true
+}
+
+func (c *Cache) staleTTL() time.Duration {
+	if c.StaleTTL > 0 {
+		return c.StaleTTL
+	}
+	return 30 * time.Second
+}
+
+// Put groups resources into RRsets, by name, type and class, and stores
+// each one until the lowest of its TTLs runs out.  An RRset replaces any
+// that's already cached, unless we trust that one more.  Resources with no
+// TTL aren't stored at all, unless MinTTL is set, which raises their TTL
+// along with any others that are too low.
+func (c *Cache) Put(resources []dns.Resource, trust Trust) {
+	rrsets := make(map[CacheKey][]dns.Resource)
+	var keys []CacheKey
+	for _, resource := range resources {
+		key := newCacheKey(dns.Question{Name: resource.Name, Type: resource.Type, Class: resource.Class})
+		if _, ok := rrsets[key]; !ok {
+			keys = append(keys, key)
+		}
+		rrsets[key] = append(rrsets[key], resource)
+	}
+
+	for _, key := range keys {
+		rrset := rrsets[key]
+		var ttl time.Duration
+		for i := range rrset {
+			rrset[i].TTL = c.clamp(rrset[i].TTL)
+			if i == 0 || rrset[i].TTL < ttl {
+				ttl = rrset[i].TTL
+			}
+		}
+		c.put(key, cacheEntry{
+			name:      rrset[0].Name,
+			resources: rrset,
+			trust:     trust,
+		}, ttl)
+	}
+}
+
+// PutResponse stores the RRsets from each section of a response, trusting
+// them according to the section that they're in and whether the response
+// is authoritative.  The response should already have been checked for
+// records that its server has no business telling us about.
+func (c *Cache) PutResponse(rsp dns.Message) {
+	if rsp.Flags.Authoritative() {
+		c.Put(rsp.Answers, TrustAnswer)
+		c.Put(rsp.Authorities, TrustAuthority)
+		c.Put(rsp.Additional, TrustAdditional)
+		return
+	}
+
+	c.Put(rsp.Answers, TrustNonAuthoritativeAnswer)
+	c.Put(rsp.Authorities, TrustGlue)
+	var glue, additional []dns.Resource
+	for _, resource := range rsp.Additional {
+		if isGlue(resource, rsp.Authorities) {
+			glue = append(glue, resource)
+		} else {
+			additional = append(additional, resource)
+		}
+	}
+	c.Put(glue, TrustGlue)
+	c.Put(additional, TrustAdditional)
+}
+
+// isGlue checks whether resource is the address of one of the name
+// servers in authorities.
+func isGlue(resource dns.Resource, authorities []dns.Resource) bool {
+	if resource.Type != dns.A && resource.Type != dns.AAAA {
+		return false
+	}
+	for _, authority := range authorities {
+		if server, ok := authority.Data.(dns.Name); ok &&
+			authority.Type == dns.NS && server.Equal(resource.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// NameServers finds the cached name servers for zone, along with any
+// cached addresses for them, whatever we think of their trustworthiness.
+func (c *Cache) NameServers(zone dns.Name) ([]NameServer, bool) {
+	nsSet, ok := c.GetRRset(zone, dns.NS, dns.IN, TrustAdditional)
+	if !ok {
+		return nil, false
+	}
 
-func (c Cache) Get(q dns.Question) ([]dns.Resource, bool) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	rs, ok := c.cache[newCacheKey(q)]
-	return rs, ok
+	var servers []NameServer
+	for _, ns := range nsSet {
+		name, ok := ns.Data.(dns.Name)
+		if !ok {
+			continue
+		}
+		server := NameServer{Name: name}
+		for _, typ := range []dns.QueryType{dns.A, dns.AAAA} {
+			addrs, _ := c.GetRRset(name, typ, dns.IN, TrustAdditional)
+			for _, addr := range addrs {
+				if ip, ok := addr.Data.(net.IP); ok {
+					server.Addrs = append(server.Addrs, ip)
+				}
+			}
+		}
+		servers = append(servers, server)
+	}
+	return servers, len(servers) > 0
+}
+
+// PutNegative remembers that the question has no answers, because the
+// name doesn't exist (dns.NameError) or it has no resources of the
+// question's type (dns.NoError).  soa is the SOA record from the
+// authority section of the response, which says how long to remember it
+// for: the lower of its TTL and its minimum TTL.
+//
+// A name that doesn't exist is remembered for every type.
+func (c *Cache) PutNegative(question dns.Question, rcode dns.ResponseCode, soa dns.Resource) {
+	data, ok := soa.Data.(dns.SOARecord)
+	if !ok || soa.Type != dns.SOA {
+		return
+	}
+
+	soa.TTL = c.clamp(min(soa.TTL, data.MinTTL))
+	if c.MaxNegativeTTL > 0 {
+		soa.TTL = min(soa.TTL, c.MaxNegativeTTL)
+	}
+
+	key := newCacheKey(question)
+	if rcode == dns.NameError {
+		key.typ = nxDomainType
+	}
+	c.put(key, cacheEntry{
+		name:      question.Name,
+		resources: []dns.Resource{soa},
+		trust:     TrustAuthority,
+		negative:  true,
+		rcode:     rcode,
+	}, soa.TTL)
+}
+
+func (c *Cache) put(key CacheKey, entry cacheEntry, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	c.setup()
+	now := c.Now()
+	entry.stored = now
+	entry.expires = now.Add(ttl)
+	c.store(key, entry, now)
+}
+
+// store stores an entry whose times have been filled in.
+func (c *Cache) store(key CacheKey, entry cacheEntry, now time.Time) {
+	shard := c.shard(key)
+	c.lock(shard)
+	defer shard.mutex.Unlock()
+	existing, replacing := shard.entries[key]
+	if replacing && existing.trust > entry.trust && now.Before(existing.expires) {
+		return
+	}
+	shard.entries[key] = entry
+	c.stats.inserts.Add(1)
+	if replacing {
+		shard.policy.Touch(key)
+		return
+	}
+	shard.policy.Add(key)
+	if !now.Before(shard.nextSweep) {
+		c.sweep(shard, now)
+		shard.nextSweep = now.Add(sweepInterval)
+	}
+	for shard.maxEntries > 0 && len(shard.entries) > shard.maxEntries {
+		victim, ok := shard.policy.Evict()
+		if !ok {
+			break
+		}
+		delete(shard.entries, victim)
+		c.stats.evictions.Add(1)
+	}
+}
+
+// sweep removes the entries in a locked shard that have expired, beyond
+// the StaleWindow.
+func (c *Cache) sweep(shard *cacheShard, now time.Time) {
+	for key, entry := range shard.entries {
+		if !now.Before(entry.expires.Add(c.StaleWindow)) {
+			delete(shard.entries, key)
+			shard.policy.Remove(key)
+			c.stats.expirations.Add(1)
+		}
+	}
+}
+
+// CacheEntry describes an entry in a Cache, for debugging.
+type CacheEntry struct {
+	Name  dns.Name
+	Type  dns.QueryType
+	Class dns.QueryClass
+
+	// Negative entries say that the name doesn't exist (dns.NameError),
+	// in which case Type is zero, or that it has no resources of the
+	// type (dns.NoError).  Resources holds the SOA record that proves it.
+	Negative bool
+	RCode    dns.ResponseCode
+
+	// TTL is how long is left until the entry expires.
+	TTL       time.Duration
+	Trust     Trust
+	Resources []dns.Resource
 }
 
-func (c Cache) Put(question dns.Question, resources []dns.Resource) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	c.cache[newCacheKey(question)] = resources
+// Entries lists the unexpired entries in the cache, sorted by name and
+// type.  The TTLs of the resources are reduced by the time they've been
+// cached, as they would be by Get.
+func (c *Cache) Entries() []CacheEntry {
+	shards := c.allShards()
+	now := c.Now()
+
+	var entries []CacheEntry
+	for i := range shards {
+		shard := &shards[i]
+		c.lock(shard)
+		for key, entry := range shard.entries {
+			if !now.Before(entry.expires) {
+				continue
+			}
+			elapsed := now.Sub(entry.stored)
+			resources := slices.Clone(entry.resources)
+			for j := range resources {
+				resources[j].TTL = ceilSeconds(resources[j].TTL - elapsed)
+			}
+			entries = append(entries, CacheEntry{
+				Name:      entry.name,
+				Type:      key.typ,
+				Class:     key.class,
+				Negative:  entry.negative,
+				RCode:     entry.rcode,
+				TTL:       ceilSeconds(entry.expires.Sub(now)),
+				Trust:     entry.trust,
+				Resources: resources,
+			})
+		}
+		shard.mutex.Unlock()
+	}
+
+	slices.SortFunc(entries, func(a, b CacheEntry) int {
+		return cmp.Or(
+			cmp.Compare(a.Name.String(), b.Name.String()),
+			cmp.Compare(a.Type, b.Type),
+			cmp.Compare(a.Class, b.Class),
+		)
+	})
+	return entries
+}
+
+// Dump writes the unexpired entries in the cache to w, one per line, with
+// their resources indented below them.
+func (c *Cache) Dump(w io.Writer) error {
+	for _, entry := range c.Entries() {
+		var err error
+		switch {
+		case entry.Negative && entry.RCode == dns.NameError:
+			_, err = fmt.Fprintf(w, "%s. %s NXDOMAIN ttl=%s\n",
+				entry.Name, entry.Class, entry.TTL)
+		case entry.Negative:
+			_, err = fmt.Fprintf(w, "%s. %s %s NODATA ttl=%s\n",
+				entry.Name, entry.Class, entry.Type, entry.TTL)
+		default:
+			_, err = fmt.Fprintf(w, "%s. %s %s ttl=%s trust=%s\n",
+				entry.Name, entry.Class, entry.Type, entry.TTL, entry.Trust)
+		}
+		if err != nil {
+			return err
+		}
+		for _, resource := range entry.Resources {
+			_, err := fmt.Fprintf(w, "\t%s. %d %s %s %v\n",
+				resource.Name, int64(resource.TTL.Seconds()), resource.Class,
+				resource.Type, resource.Data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Cache) clamp(ttl time.Duration) time.Duration {
+	if ttl < c.MinTTL {
+		ttl = c.MinTTL
+	}
+	if c.MaxTTL > 0 && ttl > c.MaxTTL {
+		ttl = c.MaxTTL
+	}
+	return ttl
+}
+
+// ceilSeconds rounds a duration up to whole seconds, since that's all
+// that a TTL can hold.  Anything still in the cache has at least a second
+// left.
+func ceilSeconds(d time.Duration) time.Duration {
+	if rem := d % time.Second; rem > 0 {
+		d += time.Second - rem
+	}
+	return d
 }
 
-func NewCache() Cache {
-	return Cache{
-		cache: make(map[cacheKey][]dns.Resource),
-		mutex: &sync.Mutex{},
+func NewCache() *Cache {
+	return &Cache{
+		Now: time.Now,
 	}
 }
@@ -3,9 +3,12 @@ package resolve_test
 import (
 	"dns"
 	"dns/resolve"
+	"fmt"
 	"net"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestCacheHit(t *testing.T) {
@@ -19,10 +22,10 @@ func TestCacheHit(t *testing.T) {
 		Name:  dns.Name{"foo", "bar"},
 		Type:  dns.A,
 		Class: dns.IN,
-		TTL:   10,
+		TTL:   10 * time.Second,
 		Data:  net.ParseIP("192.168.0.1"),
 	}
-	c.Put(q, []dns.Resource{r})
+	c.Put([]dns.Resource{r}, resolve.TrustAnswer)
 	gotR, ok := c.Get(q)
 	if !ok {
 		t.Fatal("cached record not found")
@@ -32,3 +35,392 @@ func TestCacheHit(t *testing.T) {
 			r, gotR)
 	}
 }
+
+func TestZeroValueCache(t *testing.T) {
+	// storing things is the first thing that it's used for:
+	var c resolve.Cache
+	putA(&c, "foo.bar")
+	c.PutNegative(question("nx.bar", dns.A), dns.NameError, soa("bar.", time.Hour, time.Minute))
+	if _, ok := c.Get(question("foo.bar", dns.A)); !ok {
+		t.Error("cached record not found")
+	}
+	if _, _, ok := c.GetNegative(question("nx.bar", dns.A)); !ok {
+		t.Error("cached negative answer not found")
+	}
+}
+
+func TestCacheIgnoresCase(t *testing.T) {
+	c := resolve.NewCache()
+	c.Put([]dns.Resource{
+		rr("example.com.", dns.NS, "NS1.Example.com."),
+		rr("ns1.example.com.", dns.A, "192.0.2.53"),
+		rr("www.example.com.", dns.A, "192.0.2.1"),
+	}, resolve.TrustAnswer)
+
+	if _, ok := c.Get(question("WwW.eXaMpLe.CoM", dns.A)); !ok {
+		t.Error("expected a hit whatever the case of the name")
+	}
+	servers, ok := c.NameServers(mustParseName("EXAMPLE.com"))
+	if !ok || len(servers) != 1 || len(servers[0].Addrs) != 1 {
+		t.Errorf("expected glue for NS1.Example.com, got %v", servers)
+	}
+}
+
+func TestCacheDoesNotConfuseDotsInLabels(t *testing.T) {
+	c := resolve.NewCache()
+	c.Put([]dns.Resource{{
+		Name:  dns.Name{"www.example", "com"},
+		Type:  dns.A,
+		Class: dns.IN,
+		TTL:   time.Minute,
+		Data:  net.ParseIP("192.0.2.66"),
+	}}, resolve.TrustAnswer)
+
+	if answers, ok := c.Get(question("www.example.com", dns.A)); ok {
+		t.Errorf("expected a miss, got %v", answers)
+	}
+}
+
+// fakeClock is a clock for the cache that only moves when told to.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestCache() (*resolve.Cache, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1_000_000, 0)}
+	c := resolve.NewCache()
+	c.Now = clock.Now
+	// one shard, so that it's clear what gets evicted
+	c.Shards = 1
+	return c, clock
+}
+
+func TestCacheDecrementsTTLs(t *testing.T) {
+	c, clock := newTestCache()
+	q := question("foo.bar", dns.A)
+	c.Put([]dns.Resource{
+		{Name: q.Name, Type: dns.A, Class: dns.IN, TTL: 10 * time.Second, Data: net.ParseIP("192.168.0.1")},
+		{Name: q.Name, Type: dns.A, Class: dns.IN, TTL: 20 * time.Second, Data: net.ParseIP("192.168.0.2")},
+	}, resolve.TrustAnswer)
+
+	clock.Advance(4 * time.Second)
+	rs, ok := c.Get(q)
+	if !ok {
+		t.Fatal("cached record not found")
+	}
+	if rs[0].TTL != 6*time.Second || rs[1].TTL != 16*time.Second {
+		t.Errorf("expected TTLs of 6s and 16s, got %s and %s", rs[0].TTL, rs[1].TTL)
+	}
+
+	// part-way through a second rounds up:
+	clock.Advance(500 * time.Millisecond)
+	rs, _ = c.Get(q)
+	if rs[0].TTL != 6*time.Second {
+		t.Errorf("expected TTL of 6s, got %s", rs[0].TTL)
+	}
+}
+
+func TestCacheExpiresAtLowestTTL(t *testing.T) {
+	c, clock := newTestCache()
+	q := question("foo.bar", dns.A)
+	c.Put([]dns.Resource{
+		{Name: q.Name, Type: dns.A, Class: dns.IN, TTL: 20 * time.Second, Data: net.ParseIP("192.168.0.1")},
+		{Name: q.Name, Type: dns.A, Class: dns.IN, TTL: 10 * time.Second, Data: net.ParseIP("192.168.0.2")},
+	}, resolve.TrustAnswer)
+
+	clock.Advance(9 * time.Second)
+	if _, ok := c.Get(q); !ok {
+		t.Fatal("expected record to still be cached")
+	}
+
+	clock.Advance(time.Second)
+	if rs, ok := c.Get(q); ok {
+		t.Fatalf("expected records to have expired, got %v", rs)
+	}
+}
+
+func TestCacheClampsTTLs(t *testing.T) {
+	for _, test := range []struct {
+		ttl, min, max, expected time.Duration
+	}{
+		{ttl: 10 * time.Second, expected: 10 * time.Second},
+		{ttl: 10 * time.Second, min: 30 * time.Second, expected: 30 * time.Second},
+		{ttl: 10 * time.Second, max: 5 * time.Second, expected: 5 * time.Second},
+		{ttl: 0, min: 30 * time.Second, expected: 30 * time.Second},
+	} {
+		t.Run(fmt.Sprintf("%s in [%s, %s]", test.ttl, test.min, test.max), func(t *testing.T) {
+			c, _ := newTestCache()
+			c.MinTTL = test.min
+			c.MaxTTL = test.max
+			q := question("foo.bar", dns.A)
+			c.Put([]dns.Resource{
+				{Name: q.Name, Type: dns.A, Class: dns.IN, TTL: test.ttl, Data: net.ParseIP("192.168.0.1")},
+			}, resolve.TrustAnswer)
+
+			rs, ok := c.Get(q)
+			if !ok {
+				t.Fatal("cached record not found")
+			}
+			if rs[0].TTL != test.expected {
+				t.Errorf("expected TTL %s, got %s", test.expected, rs[0].TTL)
+			}
+		})
+	}
+}
+
+func TestCacheIgnoresZeroTTL(t *testing.T) {
+	c, _ := newTestCache()
+	q := question("foo.bar", dns.A)
+	c.Put([]dns.Resource{
+		{Name: q.Name, Type: dns.A, Class: dns.IN, TTL: 0, Data: net.ParseIP("192.168.0.1")},
+	}, resolve.TrustAnswer)
+
+	if rs, ok := c.Get(q); ok {
+		t.Fatalf("expected nothing to be cached, got %v", rs)
+	}
+}
+
+func soa(zone string, ttl, minTTL time.Duration) dns.Resource {
+	return dns.Resource{
+		Name:  mustParseName(zone),
+		Type:  dns.SOA,
+		Class: dns.IN,
+		TTL:   ttl,
+		Data: dns.SOARecord{
+			MName:  mustParseName("ns." + zone),
+			RName:  mustParseName("hostmaster." + zone),
+			MinTTL: minTTL,
+		},
+	}
+}
+
+func TestCacheNXDomainAppliesToAllTypes(t *testing.T) {
+	c, _ := newTestCache()
+	c.PutNegative(question("nope.foo.bar", dns.A), dns.NameError, soa("foo.bar.", time.Hour, time.Minute))
+
+	for _, typ := range []dns.QueryType{dns.A, dns.AAAA, dns.MX} {
+		rcode, _, ok := c.GetNegative(question("nope.foo.bar", typ))
+		if !ok || rcode != dns.NameError {
+			t.Errorf("%s: expected a cached NXDOMAIN, got %s, %v", typ, rcode, ok)
+		}
+	}
+}
+
+func TestCacheNoDataIsPerType(t *testing.T) {
+	c, _ := newTestCache()
+	c.PutNegative(question("foo.bar", dns.AAAA), dns.NoError, soa("foo.bar.", time.Hour, time.Minute))
+
+	if rcode, _, ok := c.GetNegative(question("foo.bar", dns.AAAA)); !ok || rcode != dns.NoError {
+		t.Errorf("expected cached NODATA, got %s, %v", rcode, ok)
+	}
+	if _, _, ok := c.GetNegative(question("foo.bar", dns.A)); ok {
+		t.Error("expected NODATA for AAAA not to apply to A")
+	}
+	if _, ok := c.Get(question("foo.bar", dns.AAAA)); ok {
+		t.Error("expected no positive answer for a negative entry")
+	}
+}
+
+func TestCacheNegativeTTL(t *testing.T) {
+	for _, test := range []struct {
+		ttl, minTTL, max, expected time.Duration
+	}{
+		{ttl: time.Hour, minTTL: time.Minute, expected: time.Minute},
+		{ttl: time.Minute, minTTL: time.Hour, expected: time.Minute},
+		{ttl: time.Hour, minTTL: time.Hour, max: 10 * time.Minute, expected: 10 * time.Minute},
+	} {
+		t.Run(fmt.Sprintf("min(%s, %s) <= %s", test.ttl, test.minTTL, test.max), func(t *testing.T) {
+			c, clock := newTestCache()
+			c.MaxNegativeTTL = test.max
+			q := question("nope.foo.bar", dns.A)
+			c.PutNegative(q, dns.NameError, soa("foo.bar.", test.ttl, test.minTTL))
+
+			clock.Advance(10 * time.Second)
+			_, got, ok := c.GetNegative(q)
+			if !ok {
+				t.Fatal("negative entry not found")
+			}
+			if got.TTL != test.expected-10*time.Second {
+				t.Errorf("expected TTL %s, got %s", test.expected-10*time.Second, got.TTL)
+			}
+
+			clock.Advance(test.expected)
+			if _, _, ok := c.GetNegative(q); ok {
+				t.Error("expected negative entry to have expired")
+			}
+		})
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	c, clock := newTestCache()
+	c.MaxEntries = 2
+	putA(c, "a.test")
+	putA(c, "b.test")
+	c.Get(question("a.test", dns.A))
+	c.Get(question("nope.test", dns.A))
+	// evicts b.test:
+	putA(c, "c.test")
+	// evicts a.test:
+	c.PutNegative(question("nope.test", dns.A), dns.NameError, soa("test.", time.Minute, time.Minute))
+	c.GetNegative(question("nope.test", dns.MX))
+	c.GetNegative(question("c.test", dns.A))
+	clock.Advance(2 * time.Hour)
+	// expired:
+	c.Get(question("c.test", dns.A))
+
+	got := c.Stats()
+	got.Locks, got.LockWait = 0, 0
+	expected := resolve.CacheStats{
+		Hits:           1,
+		Misses:         2,
+		NegativeHits:   1,
+		NegativeMisses: 1,
+		Inserts:        4,
+		Evictions:      2,
+		Expirations:    1,
+		Size:           1,
+	}
+	if got != expected {
+		t.Errorf("expected stats:\n%+v\ngot:\n%+v", expected, got)
+	}
+}
+
+func TestCacheDump(t *testing.T) {
+	c, clock := newTestCache()
+	putA(c, "b.test")
+	putA(c, "a.test")
+	c.PutNegative(question("nope.test", dns.A), dns.NameError, soa("test.", time.Minute, time.Minute))
+	c.PutNegative(question("a.test", dns.MX), dns.NoError, soa("test.", time.Minute, time.Minute))
+	clock.Advance(10 * time.Second)
+
+	var b strings.Builder
+	if err := c.Dump(&b); err != nil {
+		t.Fatal(err)
+	}
+	expected := `a.test. IN A ttl=59m50s trust=answer
+	a.test. 3590 IN A 192.0.2.1
+a.test. IN MX NODATA ttl=50s
+	test. 50 IN SOA ` + fmt.Sprint(soa("test.", 0, time.Minute).Data) + `
+b.test. IN A ttl=59m50s trust=answer
+	b.test. 3590 IN A 192.0.2.1
+nope.test. IN NXDOMAIN ttl=50s
+	test. 50 IN SOA ` + fmt.Sprint(soa("test.", 0, time.Minute).Data) + `
+`
+	if b.String() != expected {
+		t.Errorf("expected dump:\n%s\ngot:\n%s", expected, b.String())
+	}
+}
+
+func TestCacheTrust(t *testing.T) {
+	glue := rr("ns.foo.bar.", dns.A, "192.0.2.1")
+	answer := rr("ns.foo.bar.", dns.A, "192.0.2.2")
+
+	c, clock := newTestCache()
+	c.Put([]dns.Resource{glue}, resolve.TrustGlue)
+	if rs, ok := c.Get(question("ns.foo.bar", dns.A)); ok {
+		t.Errorf("expected glue not to be used for answers, got %v", rs)
+	}
+
+	c.Put([]dns.Resource{answer}, resolve.TrustAnswer)
+	c.Put([]dns.Resource{glue}, resolve.TrustGlue)
+	rs, ok := c.Get(question("ns.foo.bar", dns.A))
+	if !ok || !rs[0].Data.(net.IP).Equal(answer.Data.(net.IP)) {
+		t.Errorf("expected glue not to replace the answer, got %v", rs)
+	}
+
+	// once the answer has expired, anything goes:
+	clock.Advance(time.Hour)
+	c.Put([]dns.Resource{glue}, resolve.TrustGlue)
+	rs, ok = c.GetRRset(glue.Name, dns.A, dns.IN, resolve.TrustAdditional)
+	if !ok || !rs[0].Data.(net.IP).Equal(glue.Data.(net.IP)) {
+		t.Errorf("expected glue to replace the expired answer, got %v", rs)
+	}
+}
+
+func TestCacheFollowsCNAMEs(t *testing.T) {
+	c, _ := newTestCache()
+	c.Put([]dns.Resource{
+		rr("www.foo.bar.", dns.CNAME, "web.foo.bar."),
+		rr("web.foo.bar.", dns.CNAME, "host.foo.bar."),
+		rr("host.foo.bar.", dns.A, "192.0.2.1"),
+	}, resolve.TrustAnswer)
+
+	rs, ok := c.Get(question("www.foo.bar", dns.A))
+	if !ok {
+		t.Fatal("expected an answer from the cache")
+	}
+	expected := []string{
+		"www.foo.bar CNAME web.foo.bar",
+		"web.foo.bar CNAME host.foo.bar",
+		"host.foo.bar A 192.0.2.1",
+	}
+	if got := describe(rs); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+
+	if _, ok := c.Get(question("www.foo.bar", dns.AAAA)); ok {
+		t.Error("expected no answer when the end of the chain isn't cached")
+	}
+}
+
+func TestCachePutResponse(t *testing.T) {
+	c, _ := newTestCache()
+	c.PutResponse(dns.Message{
+		Authorities: []dns.Resource{rr("foo.bar.", dns.NS, "ns.foo.bar.")},
+		Additional: []dns.Resource{
+			rr("ns.foo.bar.", dns.A, "192.0.2.1"),
+			rr("other.foo.bar.", dns.A, "192.0.2.2"),
+		},
+	})
+
+	var got []string
+	for _, entry := range c.Entries() {
+		got = append(got, fmt.Sprintf("%s %s %s", entry.Name, entry.Type, entry.Trust))
+	}
+	expected := []string{
+		"foo.bar NS glue",
+		"ns.foo.bar A glue",
+		"other.foo.bar A additional",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+
+	servers, ok := c.NameServers(mustParseName("foo.bar."))
+	if !ok || len(servers) != 1 || len(servers[0].Addrs) != 1 {
+		t.Errorf("expected one name server with glue, got %v", servers)
+	}
+}
+
+func TestCacheGetStale(t *testing.T) {
+	c, clock := newTestCache()
+	c.StaleWindow = time.Hour
+	q := question("foo.bar", dns.A)
+	putA(c, "foo.bar")
+
+	clock.Advance(time.Hour + time.Second)
+	if rs, ok := c.Get(q); ok {
+		t.Errorf("expected no fresh answer, got %v", rs)
+	}
+	rs, ok := c.GetStale(q)
+	if !ok {
+		t.Fatal("expected a stale answer")
+	}
+	if rs[0].TTL != 30*time.Second {
+		t.Errorf("expected a stale TTL of 30s, got %s", rs[0].TTL)
+	}
+
+	clock.Advance(time.Hour)
+	if rs, ok := c.GetStale(q); ok {
+		t.Errorf("expected the stale answer to have gone, got %v", rs)
+	}
+}
@@ -0,0 +1,174 @@
+package resolve
+
+import (
+	"context"
+	"dns"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+)
+
+// maxChainLength limits how many CNAME and DNAME records we'll follow
+// while resolving a single question.
+const maxChainLength = 8
+
+var ErrChainLoop = errors.New("CNAME/DNAME loop")
+var ErrChainTooLong = errors.New("CNAME/DNAME chain too long")
+
+// resolveChain resolves the question from the closest zone that we know
+// the servers for, following any CNAME and DNAME records to the eventual
+// answer.  The records of the chain come first in the answers, in the
+// order that they were followed.
+func (r *Resolver) resolveChain(ctx context.Context, b *budget, question dns.Question) (dns.Message, error) {
+	var chain []dns.Resource
+	visited := []dns.Name{question.Name}
+	for {
+		rsp, err := r.resolveFromClosest(ctx, b, question)
+		if err != nil {
+			return dns.Message{}, err
+		}
+
+		links, final, next, err := followChain(question, rsp.Answers, &visited)
+		if err != nil {
+			return dns.Message{}, err
+		}
+		chain = append(chain, links...)
+		if next == nil {
+			rsp.Answers = append(chain, final...)
+			return rsp, nil
+		}
+
+		// the rest of the chain wasn't in the response, probably
+		// because it's in a different zone:
+		r.logger().Debug("following chain",
+			qnameAttr(question.Name), qtypeAttr(question.Type), slog.String("target", next.String()))
+		traceEvent(ctx, TraceEvent{Kind: TraceChain, Question: question, Target: next})
+		question.Name = next
+	}
+}
+
+// followChain follows any CNAME and DNAME records in answers, starting
+// from the name in the question.  It returns the records that were
+// followed, and either the answers at the end of the chain, or the name
+// that the chain leads to if the answers don't say anything about it.
+//
+// Every name that we pass through is added to visited, so that we can
+// tell if we've been there before.
+func followChain(question dns.Question, answers []dns.Resource, visited *[]dns.Name) ([]dns.Resource, []dns.Resource, dns.Name, error) {
+	var chain []dns.Resource
+	name := question.Name
+	for {
+		if final := recordsAt(name, question.Type, answers); len(final) > 0 {
+			return chain, final, nil, nil
+		}
+
+		links, target, err := nextLink(name, question.Type, answers)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if links == nil {
+			if len(chain) == 0 {
+				// nothing found, but nothing left to follow either
+				return nil, nil, nil, nil
+			}
+			return chain, nil, name, nil
+		}
+		chain = append(chain, links...)
+
+		if slices.ContainsFunc(*visited, target.Equal) {
+			return nil, nil, nil, fmt.Errorf("%w: %s is already in the chain", ErrChainLoop, target)
+		}
+		if len(*visited) > maxChainLength {
+			return nil, nil, nil, fmt.Errorf("%w: more than %d links from %s",
+				ErrChainTooLong, maxChainLength, (*visited)[0])
+		}
+		*visited = append(*visited, target)
+		name = target
+	}
+}
+
+// hasAnswer checks whether the answers either answer the question or
+// redirect it elsewhere.
+func hasAnswer(question dns.Question, answers []dns.Resource) bool {
+	if len(recordsAt(question.Name, question.Type, answers)) > 0 {
+		return true
+	}
+	links, _, err := nextLink(question.Name, question.Type, answers)
+	return links != nil || err != nil
+}
+
+func recordsAt(name dns.Name, typ dns.QueryType, answers []dns.Resource) []dns.Resource {
+	var records []dns.Resource
+	for _, answer := range answers {
+		if answer.Type == typ && answer.Name.Equal(name) {
+			records = append(records, answer)
+		}
+	}
+	return records
+}
+
+// nextLink finds the records that redirect name elsewhere, if any, and
+// where they redirect it to.
+//
+// DNAMEs are preferred over CNAMEs, since any CNAME for a name below a
+// DNAME ought to be a copy of the one we'd synthesise anyway.  Both the
+// DNAME and the synthesised CNAME are returned, as in RFC 6672.
+func nextLink(name dns.Name, typ dns.QueryType, answers []dns.Resource) ([]dns.Resource, dns.Name, error) {
+	if typ != dns.DNAME {
+		for _, answer := range answers {
+			if answer.Type == dns.DNAME && name.IsSubdomainOf(answer.Name) {
+				cname, err := synthesiseCNAME(name, answer)
+				if err != nil {
+					return nil, nil, err
+				}
+				return []dns.Resource{answer, cname}, cname.Data.(dns.Name), nil
+			}
+		}
+	}
+
+	if typ != dns.CNAME {
+		for _, answer := range answers {
+			target, ok := answer.Data.(dns.Name)
+			if ok && answer.Type == dns.CNAME && answer.Name.Equal(name) {
+				return []dns.Resource{answer}, target, nil
+			}
+		}
+	}
+
+	return nil, nil, nil
+}
+
+// synthesiseCNAME creates a CNAME for name, which is below the owner of
+// the DNAME, by replacing the owner with the DNAME's target.
+func synthesiseCNAME(name dns.Name, dname dns.Resource) (dns.Resource, error) {
+	target, ok := dname.Data.(dns.Name)
+	if !ok {
+		return dns.Resource{}, fmt.Errorf("invalid DNAME data %T", dname.Data)
+	}
+
+	prefix := name[:len(name)-len(dname.Name)]
+	synthesised := append(slices.Clone(prefix), target...)
+	if wireLength(synthesised) > 255 {
+		return dns.Resource{}, fmt.Errorf("DNAME %s for %s: %w",
+			dname.Name, name, dns.ErrNameTooLong)
+	}
+
+	return dns.Resource{
+		Name:  name,
+		Type:  dns.CNAME,
+		Class: dname.Class,
+		TTL:   dname.TTL,
+		Data:  synthesised,
+	}, nil
+}
+
+// wireLength is the number of bytes that the name takes up in a message,
+// without compression.
+func wireLength(name dns.Name) int {
+	length := 1
+	for _, label := range name {
+		length += len(label) + 1
+	}
+	return length
+}
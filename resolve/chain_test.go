@@ -0,0 +1,207 @@
+package resolve_test
+
+import (
+	"context"
+	"dns"
+	"dns/resolve"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// chainNet is testNet with the given records added to example.com, and
+// an example.net zone too.
+func chainNet(records ...dns.Resource) fakeNet {
+	n := testNet()
+	n["10.0.0.1"] = zone(
+		rr(".", dns.NS, "a.root."),
+		rr("com.", dns.NS, "ns.com."),
+		rr("ns.com.", dns.A, "10.0.1.1"),
+		rr("net.", dns.NS, "ns.net."),
+		rr("ns.net.", dns.A, "10.0.3.1"),
+	)
+	n["10.0.2.1"] = zone(append([]dns.Resource{
+		rr("example.com.", dns.NS, "ns.example.com."),
+	}, records...)...)
+	n["10.0.3.1"] = zone(
+		rr("net.", dns.NS, "ns.net."),
+		rr("example.net.", dns.NS, "ns.example.net."),
+		rr("ns.example.net.", dns.A, "10.0.4.1"),
+	)
+	n["10.0.4.1"] = zone(
+		rr("example.net.", dns.NS, "ns.example.net."),
+		rr("www.example.net.", dns.A, "192.0.2.2"),
+	)
+	return n
+}
+
+func TestFollowChains(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		records  []dns.Resource
+		expected []dns.Resource
+	}{
+		{
+			name: "cname in the same response",
+			records: []dns.Resource{
+				rr("www.example.com.", dns.CNAME, "web.example.com."),
+				rr("web.example.com.", dns.A, "192.0.2.1"),
+			},
+			expected: []dns.Resource{
+				rr("www.example.com.", dns.CNAME, "web.example.com."),
+				rr("web.example.com.", dns.A, "192.0.2.1"),
+			},
+		},
+		{
+			name: "cname in the same zone",
+			records: []dns.Resource{
+				rr("www.example.com.", dns.CNAME, "web.example.com."),
+				rr("web.example.com.", dns.CNAME, "host.example.com."),
+				rr("host.example.com.", dns.A, "192.0.2.1"),
+			},
+			expected: []dns.Resource{
+				rr("www.example.com.", dns.CNAME, "web.example.com."),
+				rr("web.example.com.", dns.CNAME, "host.example.com."),
+				rr("host.example.com.", dns.A, "192.0.2.1"),
+			},
+		},
+		{
+			name: "cname to another zone",
+			records: []dns.Resource{
+				rr("www.example.com.", dns.CNAME, "www.example.net."),
+			},
+			expected: []dns.Resource{
+				rr("www.example.com.", dns.CNAME, "www.example.net."),
+				rr("www.example.net.", dns.A, "192.0.2.2"),
+			},
+		},
+		{
+			name: "dname",
+			records: []dns.Resource{
+				rr("example.com.", dns.DNAME, "example.net."),
+			},
+			expected: []dns.Resource{
+				rr("example.com.", dns.DNAME, "example.net."),
+				rr("www.example.com.", dns.CNAME, "www.example.net."),
+				rr("www.example.net.", dns.A, "192.0.2.2"),
+			},
+		},
+		{
+			name: "dname with bogus cname",
+			records: []dns.Resource{
+				rr("example.com.", dns.DNAME, "example.net."),
+				rr("www.example.com.", dns.CNAME, "elsewhere.example.com."),
+			},
+			expected: []dns.Resource{
+				rr("example.com.", dns.DNAME, "example.net."),
+				rr("www.example.com.", dns.CNAME, "www.example.net."),
+				rr("www.example.net.", dns.A, "192.0.2.2"),
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestResolver(chainNet(test.records...))
+			rsp, err := r.Resolve(context.Background(), question("www.example.com", dns.A))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, exp := fmt.Sprint(describe(rsp.Answers)), fmt.Sprint(describe(test.expected)); got != exp {
+				t.Errorf("expected answers:\n%s\ngot:\n%s", exp, got)
+			}
+		})
+	}
+}
+
+func TestCNAMEQueryIsNotFollowed(t *testing.T) {
+	r := newTestResolver(chainNet(
+		rr("www.example.com.", dns.CNAME, "www.example.net."),
+	))
+	rsp, err := r.Resolve(context.Background(), question("www.example.com", dns.CNAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rsp.Answers) != 1 || rsp.Answers[0].Type != dns.CNAME {
+		t.Errorf("expected just the CNAME, got %s", describe(rsp.Answers))
+	}
+}
+
+func TestChainLoops(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		records []dns.Resource
+	}{
+		{
+			name: "to itself",
+			records: []dns.Resource{
+				rr("www.example.com.", dns.CNAME, "www.example.com."),
+			},
+		},
+		{
+			name: "in one response",
+			records: []dns.Resource{
+				rr("www.example.com.", dns.CNAME, "web.example.com."),
+				rr("web.example.com.", dns.CNAME, "www.example.com."),
+			},
+		},
+		{
+			name: "across zones",
+			records: []dns.Resource{
+				rr("www.example.com.", dns.CNAME, "www.example.net."),
+				rr("web.example.com.", dns.CNAME, "www.example.com."),
+			},
+		},
+		{
+			name: "dname to a child",
+			records: []dns.Resource{
+				rr("example.com.", dns.DNAME, "sub.example.com."),
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			n := chainNet(test.records...)
+			n["10.0.4.1"] = zone(
+				rr("example.net.", dns.NS, "ns.example.net."),
+				rr("www.example.net.", dns.CNAME, "web.example.com."),
+			)
+			r := newTestResolver(n)
+
+			_, err := r.Resolve(context.Background(), question("www.example.com", dns.A))
+			if !errors.Is(err, resolve.ErrChainLoop) && !errors.Is(err, resolve.ErrChainTooLong) {
+				t.Fatalf("expected a chain error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestChainTooLong(t *testing.T) {
+	var records []dns.Resource
+	for i := range 20 {
+		records = append(records, rr(
+			fmt.Sprintf("c%d.example.com.", i),
+			dns.CNAME,
+			fmt.Sprintf("c%d.example.com.", i+1),
+		))
+	}
+	records = append(records, rr("c20.example.com.", dns.A, "192.0.2.1"))
+	r := newTestResolver(chainNet(records...))
+
+	_, err := r.Resolve(context.Background(), question("c0.example.com", dns.A))
+	if !errors.Is(err, resolve.ErrChainTooLong) {
+		t.Fatalf("expected the chain to be too long, got %v", err)
+	}
+}
+
+// describe formats resources in a way that's easy to compare.
+func describe(resources []dns.Resource) []string {
+	var described []string
+	for _, resource := range resources {
+		data := resource.Data
+		if ip, ok := data.(net.IP); ok {
+			data = ip.String()
+		}
+		described = append(described, fmt.Sprintf("%s %s %s",
+			resource.Name, resource.Type, data))
+	}
+	return described
+}
@@ -0,0 +1,78 @@
+package resolve
+
+import "container/list"
+
+// EvictionPolicy chooses which entries to evict when a Cache is full.
+//
+// The cache tells the policy about every entry that it adds, reads or
+// removes, and asks it for a victim when there are too many.  The cache
+// holds its lock while doing so, so policies needn't be safe for
+// concurrent use.
+type EvictionPolicy interface {
+	// Add is called when a new entry is stored.
+	Add(key CacheKey)
+	// Touch is called when an entry is read, or replaced.
+	Touch(key CacheKey)
+	// Remove is called when an entry is removed by the cache itself,
+	// eg because it expired.
+	Remove(key CacheKey)
+	// Evict chooses an entry to evict, and forgets about it.  It returns
+	// false if it has nothing left to evict.
+	Evict() (CacheKey, bool)
+}
+
+// LRU evicts the least recently used entry.
+type LRU struct {
+	order    *list.List // most recently used at the front
+	elements map[CacheKey]*list.Element
+}
+
+func NewLRU() *LRU {
+	return &LRU{
+		order:    list.New(),
+		elements: make(map[CacheKey]*list.Element),
+	}
+}
+
+func (p *LRU) Add(key CacheKey) {
+	if e, ok := p.elements[key]; ok {
+		p.order.MoveToFront(e)
+		return
+	}
+	p.elements[key] = p.order.PushFront(key)
+}
+
+func (p *LRU) Touch(key CacheKey) {
+	if e, ok := p.elements[key]; ok {
+		p.order.MoveToFront(e)
+	}
+}
+
+func (p *LRU) Remove(key CacheKey) {
+	if e, ok := p.elements[key]; ok {
+		p.order.Remove(e)
+		delete(p.elements, key)
+	}
+}
+
+func (p *LRU) Evict() (CacheKey, bool) {
+	e := p.order.Back()
+	if e == nil {
+		return CacheKey{}, false
+	}
+	key := p.order.Remove(e).(CacheKey)
+	delete(p.elements, key)
+	return key, true
+}
+
+// FIFO evicts the oldest entry, no matter how often it's used.  It's
+// mostly useful as a baseline for comparing other policies with.
+type FIFO struct {
+	LRU
+}
+
+func NewFIFO() *FIFO {
+	return &FIFO{LRU: *NewLRU()}
+}
+
+func (p *FIFO) Touch(key CacheKey) {}
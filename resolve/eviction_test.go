@@ -0,0 +1,128 @@
+package resolve_test
+
+import (
+	"dns"
+	"dns/resolve"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func putA(c *resolve.Cache, name string) {
+	q := question(name, dns.A)
+	c.Put([]dns.Resource{
+		{Name: q.Name, Type: dns.A, Class: dns.IN, TTL: time.Hour, Data: net.ParseIP("192.0.2.1")},
+	}, resolve.TrustAnswer)
+}
+
+func cached(c *resolve.Cache, names ...string) []string {
+	var found []string
+	for _, name := range names {
+		if _, ok := c.Get(question(name, dns.A)); ok {
+			found = append(found, name)
+		}
+	}
+	return found
+}
+
+func TestEviction(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		policy   func() resolve.EvictionPolicy
+		expected []string
+	}{
+		// a. is used again before d. is added, so b. is evicted instead
+		{"LRU", func() resolve.EvictionPolicy { return resolve.NewLRU() }, []string{"a.test", "c.test", "d.test"}},
+		{"FIFO", func() resolve.EvictionPolicy { return resolve.NewFIFO() }, []string{"b.test", "c.test", "d.test"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c, _ := newTestCache()
+			c.MaxEntries = 3
+			c.NewPolicy = test.policy
+
+			putA(c, "a.test")
+			putA(c, "b.test")
+			putA(c, "c.test")
+			cached(c, "a.test")
+			putA(c, "d.test")
+
+			got := cached(c, "a.test", "b.test", "c.test", "d.test")
+			if fmt.Sprint(got) != fmt.Sprint(test.expected) {
+				t.Errorf("expected %v to be cached, got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestEvictionKeepsCacheBounded(t *testing.T) {
+	c, _ := newTestCache()
+	c.MaxEntries = 10
+	var names []string
+	for i := range 100 {
+		name := fmt.Sprintf("host%d.test", i)
+		names = append(names, name)
+		putA(c, name)
+	}
+
+	got := cached(c, names...)
+	if len(got) != 10 {
+		t.Fatalf("expected 10 entries to be cached, got %d", len(got))
+	}
+	if got[0] != "host90.test" {
+		t.Errorf("expected the most recent entries to be cached, got %v", got)
+	}
+}
+
+func TestShardedCacheIsBounded(t *testing.T) {
+	c := resolve.NewCache()
+	c.Shards = 4
+	c.MaxEntries = 100
+	var names []string
+	for i := range 1000 {
+		name := fmt.Sprintf("host%d.test", i)
+		names = append(names, name)
+		putA(c, name)
+	}
+
+	// each shard holds up to 25 entries, but the keys won't be spread
+	// perfectly evenly:
+	got := len(cached(c, names...))
+	if got > 100 || got < 90 {
+		t.Errorf("expected about 100 entries to be cached, got %d", got)
+	}
+	if size := c.Stats().Size; size != got {
+		t.Errorf("expected a size of %d, got %d", got, size)
+	}
+}
+
+func TestExpiredEntriesAreSwept(t *testing.T) {
+	c, clock := newTestCache()
+	for i := range 100 {
+		putA(c, fmt.Sprintf("%d.test", i))
+	}
+
+	// nothing reads the old entries again, but storing a new one after
+	// they've expired clears them out:
+	clock.Advance(2 * time.Hour)
+	putA(c, "new.test")
+	stats := c.Stats()
+	if stats.Size != 1 || stats.Expirations != 100 {
+		t.Errorf("expected only the new entry to be left, got %+v", stats)
+	}
+}
+
+func TestExpiredEntriesMakeRoomBeforeEviction(t *testing.T) {
+	c, clock := newTestCache()
+	c.MaxEntries = 3
+	putA(c, "a.test")
+	putA(c, "b.test")
+	clock.Advance(2 * time.Hour)
+	putA(c, "c.test")
+	putA(c, "d.test")
+	putA(c, "e.test")
+
+	if got := c.Stats().Evictions; got != 0 {
+		t.Errorf("expected the expired entries to make room, got %d evictions", got)
+	}
+}
@@ -0,0 +1,191 @@
+package resolve
+
+import (
+	"context"
+	"dns"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"time"
+)
+
+// AddressFamily selects which kinds of addresses are used to contact
+// name servers.
+type AddressFamily int
+
+const (
+	// HappyEyeballs uses both IPv6 and IPv4 addresses, alternating between
+	// them and starting with IPv6.  If a server doesn't respond quickly,
+	// the next one is queried in parallel, in the style of RFC 8305.
+	HappyEyeballs AddressFamily = iota
+	IPv4Only
+	IPv6Only
+)
+
+func (f AddressFamily) String() string {
+	switch f {
+	case HappyEyeballs:
+		return "HappyEyeballs"
+	case IPv4Only:
+		return "IPv4Only"
+	case IPv6Only:
+		return "IPv6Only"
+	default:
+		return fmt.Sprintf("AddressFamily(%d)", int(f))
+	}
+}
+
+// ParseAddressFamily parses "ipv4", "ipv6" or "happy-eyeballs".
+func ParseAddressFamily(s string) (AddressFamily, error) {
+	switch s {
+	case "happy-eyeballs":
+		return HappyEyeballs, nil
+	case "ipv4":
+		return IPv4Only, nil
+	case "ipv6":
+		return IPv6Only, nil
+	default:
+		return 0, fmt.Errorf("unknown address family %q", s)
+	}
+}
+
+func (f AddressFamily) allows(ip net.IP) bool {
+	switch f {
+	case IPv4Only:
+		return ip.To4() != nil
+	case IPv6Only:
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
+
+// queryTypes are the types of address records to look up for a name
+// server, in the order that they should be looked up.
+func (f AddressFamily) queryTypes() []dns.QueryType {
+	switch f {
+	case IPv4Only:
+		return []dns.QueryType{dns.A}
+	case IPv6Only:
+		return []dns.QueryType{dns.AAAA}
+	default:
+		return []dns.QueryType{dns.AAAA, dns.A}
+	}
+}
+
+// order drops any addresses that we aren't allowed to use and shuffles the
+// rest, to spread the load between servers.  With HappyEyeballs, the two
+// families are interleaved, starting with IPv6.
+func (f AddressFamily) order(addrs []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range addrs {
+		if !f.allows(ip) {
+			continue
+		}
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	shuffle(v4)
+	shuffle(v6)
+
+	ordered := make([]net.IP, 0, len(v4)+len(v6))
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			ordered = append(ordered, v6[i])
+		}
+		if i < len(v4) {
+			ordered = append(ordered, v4[i])
+		}
+	}
+	return ordered
+}
+
+func shuffle(ips []net.IP) {
+	rand.Shuffle(len(ips), func(i, j int) {
+		ips[i], ips[j] = ips[j], ips[i]
+	})
+}
+
+// addrsOf returns the addresses of the given servers, in the order that
+// they should be tried.
+func (r *Resolver) addrsOf(servers []NameServer) []net.IP {
+	var addrs []net.IP
+	for _, server := range servers {
+		addrs = append(addrs, server.Addrs...)
+	}
+	return r.Family.order(addrs)
+}
+
+const defaultAttemptDelay = 250 * time.Millisecond
+
+// exchange sends the question to each of the servers for zone in turn
+// until one of them responds.  With HappyEyeballs, we don't wait for a server to fail
+// before trying the next one, only for AttemptDelay, and whichever
+// responds first wins.  A server that responds with SERVFAIL or the like
+// has failed as much as one that doesn't respond at all.
+func (r *Resolver) exchange(ctx context.Context, b *budget, zone dns.Name, addrs []net.IP, question dns.Question) (dns.Message, error) {
+	if len(addrs) == 0 {
+		return dns.Message{}, errors.New("no server addresses to query")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		ip  net.IP
+		rsp dns.Message
+		err error
+	}
+	results := make(chan result, len(addrs))
+	next, inFlight := 0, 0
+	var errs []error
+	startNext := func() {
+		if err := b.query(); err != nil {
+			errs = append(errs, err)
+			next = len(addrs) // no more attempts
+			return
+		}
+		ip := addrs[next]
+		next++
+		inFlight++
+		go func() {
+			rsp, err := exchangeTraced(ctx, r.transport(), zone, ip, newQuery(question))
+			if rcode := rsp.Flags.ResponseCode(); err == nil && serverFailed(rcode) {
+				err = fmt.Errorf("%w: %s", ErrServerFailed, rcode)
+			}
+			results <- result{ip, rsp, err}
+		}()
+	}
+
+	delay := r.AttemptDelay
+	if delay == 0 {
+		delay = defaultAttemptDelay
+	}
+
+	startNext()
+	for inFlight > 0 {
+		var attemptTimer <-chan time.Time
+		if r.Family == HappyEyeballs && next < len(addrs) {
+			attemptTimer = time.After(delay)
+		}
+
+		select {
+		case res := <-results:
+			inFlight--
+			if res.err == nil {
+				return res.rsp, nil
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", res.ip, res.err))
+			if next < len(addrs) {
+				startNext()
+			}
+		case <-attemptTimer:
+			startNext()
+		}
+	}
+	return dns.Message{}, errors.Join(errs...)
+}
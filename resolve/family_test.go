@@ -0,0 +1,191 @@
+package resolve_test
+
+import (
+	"context"
+	"dns"
+	"dns/resolve"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// loopbackNet is a Transport that sends queries over UDP to stand-in
+// servers on ::1, identified by port, so that we can pretend to have many
+// servers with different addresses.
+type loopbackNet map[string]int
+
+func (n loopbackNet) Exchange(ctx context.Context, server net.IP, query dns.Message) (dns.Message, error) {
+	port, ok := n[server.String()]
+	if !ok {
+		return dns.Message{}, &net.AddrError{Err: "no route to host", Addr: server.String()}
+	}
+	return resolve.UDPTransport{Port: port}.Exchange(ctx, net.IPv6loopback, query)
+}
+
+// standIn serves responses from srv over UDP on ::1, returning the port.
+func standIn(t *testing.T, srv fakeServer) int {
+	t.Helper()
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			qry, err := dns.ParseMessage(buf[:n])
+			if err != nil || len(qry.Questions) != 1 {
+				continue
+			}
+			rspBuf, err := srv.serve(qry).WriteTo(nil)
+			if err != nil {
+				t.Errorf("stand-in couldn't write response: %s", err)
+				continue
+			}
+			conn.WriteToUDP(rspBuf, addr)
+		}
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestResolveOverIPv6(t *testing.T) {
+	n := loopbackNet{
+		"fd00::1": standIn(t, zone(
+			rr(".", dns.NS, "a.root."),
+			rr("com.", dns.NS, "ns.com."),
+			rr("ns.com.", dns.A, "10.0.1.1"),
+			rr("ns.com.", dns.AAAA, "fd00::2"),
+		)),
+		"fd00::2": standIn(t, zone(
+			rr("com.", dns.NS, "ns.com."),
+			rr("example.com.", dns.NS, "ns.example.com."),
+			rr("ns.example.com.", dns.AAAA, "fd00::3"),
+		)),
+		"fd00::3": standIn(t, zone(
+			rr("example.com.", dns.NS, "ns.example.com."),
+			rr("www.example.com.", dns.AAAA, "2001:db8::1"),
+		)),
+	}
+	r := newTestResolver(n, "fd00::1")
+	r.Family = resolve.IPv6Only
+
+	rsp, err := r.Resolve(context.Background(), question("www.example.com", dns.AAAA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rsp.Answers) != 1 {
+		t.Fatalf("expected 1 answer, got %d", len(rsp.Answers))
+	}
+	if ip, _ := rsp.Answers[0].Data.(net.IP); !ip.Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("expected 2001:db8::1, got %s", rsp.Answers[0].Data)
+	}
+}
+
+// dualStackNet delegates com to a name server in a different zone, which
+// has both an IPv4 and an IPv6 address.
+func dualStackNet() fakeNet {
+	com := zone(
+		rr("com.", dns.NS, "ns.net."),
+		rr("example.com.", dns.A, "192.0.2.1"),
+	)
+	root := zone(
+		rr(".", dns.NS, "a.root."),
+		rr("com.", dns.NS, "ns.net."),
+		rr("net.", dns.NS, "ns.nic.net."),
+		rr("ns.nic.net.", dns.A, "10.0.3.1"),
+		rr("ns.nic.net.", dns.AAAA, "fd00::3"),
+	)
+	netZone := zone(
+		rr("net.", dns.NS, "ns.nic.net."),
+		rr("ns.net.", dns.A, "10.0.1.1"),
+		rr("ns.net.", dns.AAAA, "fd00::1"),
+	)
+	return fakeNet{
+		"10.0.0.1": root,
+		"fd00::10": root,
+		"10.0.3.1": netZone,
+		"fd00::3":  netZone,
+		"10.0.1.1": com,
+		"fd00::1":  com,
+	}
+}
+
+func TestAddressFamilyOfNameServerLookups(t *testing.T) {
+	for _, test := range []struct {
+		family   resolve.AddressFamily
+		expected string
+		other    string
+	}{
+		{resolve.IPv4Only, "10.0.1.1", "fd00::1"},
+		{resolve.IPv6Only, "fd00::1", "10.0.1.1"},
+		{resolve.HappyEyeballs, "fd00::1", "10.0.1.1"},
+	} {
+		t.Run(test.family.String(), func(t *testing.T) {
+			var queried []string
+			r := newTestResolver(dualStackNet().record(&queried), "10.0.0.1", "fd00::10")
+			r.Family = test.family
+
+			_, err := r.Resolve(context.Background(), question("example.com", dns.A))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Contains(queried, test.expected) {
+				t.Errorf("expected %s to be queried, got %s", test.expected, queried)
+			}
+			if slices.Contains(queried, test.other) {
+				t.Errorf("expected %s not to be queried, got %s", test.other, queried)
+			}
+		})
+	}
+}
+
+func TestHappyEyeballsFallsBackToIPv4(t *testing.T) {
+	n := dualStackNet()
+	n["fd00::1"] = nil // never responds
+	r := newTestResolver(n, "10.0.0.1", "fd00::10")
+	r.AttemptDelay = time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	rsp, err := r.Resolve(ctx, question("example.com", dns.A))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rsp.Answers) != 1 {
+		t.Errorf("expected 1 answer, got %d", len(rsp.Answers))
+	}
+}
+
+func TestIPv4OnlyIgnoresIPv6Glue(t *testing.T) {
+	n := fakeNet{
+		"10.0.0.1": zone(
+			rr(".", dns.NS, "a.root."),
+			rr("com.", dns.NS, "ns.com."),
+			rr("ns.com.", dns.AAAA, "fd00::1"),
+		),
+		"fd00::1": zone(
+			rr("com.", dns.NS, "ns.com."),
+			rr("example.com.", dns.A, "192.0.2.1"),
+		),
+	}
+	r := newTestResolver(n)
+	r.Family = resolve.IPv4Only
+
+	if _, err := r.Resolve(context.Background(), question("example.com", dns.A)); err == nil {
+		t.Error("expected resolution to fail without an IPv4 address for ns.com")
+	}
+
+	// without the referral to ns.com cached from the first attempt:
+	r.Cache = resolve.NewCache()
+	r.Family = resolve.IPv6Only
+	if _, err := r.Resolve(context.Background(), question("example.com", dns.A)); err == nil {
+		t.Error("expected resolution to fail without an IPv6 root server")
+	}
+}
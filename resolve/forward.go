@@ -0,0 +1,367 @@
+package resolve
+
+import (
+	"context"
+	"dns"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Forwarding queries to upstream recursive resolvers, instead of iterating
+// from the root ourselves.
+//
+// Upstreams that keep failing are left alone for a while, so that every
+// query doesn't have to wait for them to time out first.  If they're all
+// cooling down, we try them all anyway, since that's better than giving up
+// without asking.
+
+// Strategy chooses which upstreams a Forwarder sends each query to.
+type Strategy int
+
+const (
+	// Sequential tries the upstreams in the order they were given,
+	// moving on to the next when one fails.
+	Sequential Strategy = iota
+	// Random tries the upstreams in a random order, to spread the load.
+	Random
+	// Fastest tries the upstreams in order of their round trip time,
+	// smoothed over recent queries.
+	Fastest
+	// Parallel sends each query to every upstream at once, and takes the
+	// first response.
+	Parallel
+)
+
+func (s Strategy) String() string {
+	switch s {
+	case Sequential:
+		return "Sequential"
+	case Random:
+		return "Random"
+	case Fastest:
+		return "Fastest"
+	case Parallel:
+		return "Parallel"
+	default:
+		return fmt.Sprintf("Strategy(%d)", int(s))
+	}
+}
+
+// ParseStrategy parses "sequential", "random", "fastest" or "parallel".
+func ParseStrategy(s string) (Strategy, error) {
+	switch s {
+	case "sequential":
+		return Sequential, nil
+	case "random":
+		return Random, nil
+	case "fastest":
+		return Fastest, nil
+	case "parallel":
+		return Parallel, nil
+	default:
+		return 0, fmt.Errorf("unknown forwarding strategy %q", s)
+	}
+}
+
+var ErrUpstreamFailed = errors.New("upstream failed")
+
+const (
+	defaultFailureThreshold = 3
+	defaultCooldown         = 30 * time.Second
+)
+
+// Forwarder resolves questions by asking upstream recursive resolvers.
+type Forwarder struct {
+	// Upstreams are the addresses of the resolvers to forward to.
+	Upstreams []net.IP
+
+	Strategy Strategy
+
+	// Transport sends queries to the upstreams.  Defaults to UDP.
+	Transport Transport
+	// TCPTransport is used to ask again when a response is truncated.
+	// Defaults to TCP.
+	TCPTransport Transport
+
+	// FailureThreshold is how many times in a row an upstream can fail
+	// before it's put in cooldown.  Defaults to 3.
+	FailureThreshold int
+	// Cooldown is how long failed upstreams are avoided for.  Defaults to
+	// 30s.
+	Cooldown time.Duration
+
+	// Cache, if it isn't nil, keeps the responses from the upstreams.
+	Cache *Cache
+
+	// Logger receives what the Forwarder is doing.  Defaults to
+	// slog.Default().
+	Logger *slog.Logger
+
+	init     sync.Once
+	mutex    sync.Mutex
+	health   map[string]*upstreamHealth
+	inflight *inflight
+}
+
+// upstreamHealth is what we've learnt about an upstream from the queries
+// that we've sent it.
+type upstreamHealth struct {
+	// failures is the number of queries in a row that have failed.
+	failures int
+	// coolUntil is when it comes out of cooldown, if it's in it.
+	coolUntil time.Time
+	// rtt is the smoothed round trip time, or zero if we don't know it.
+	rtt time.Duration
+}
+
+// NewForwarder creates a Forwarder that sends queries to the upstreams
+// over UDP, sequentially, and caches their responses.
+func NewForwarder(upstreams ...net.IP) *Forwarder {
+	return &Forwarder{
+		Upstreams:    upstreams,
+		Transport:    UDPTransport{},
+		TCPTransport: TCPTransport{},
+		Cache:        NewCache(),
+	}
+}
+
+// setup makes the state that isn't configured, the first time that it's
+// needed, so that a Forwarder doesn't have to come from NewForwarder.
+func (f *Forwarder) setup() {
+	f.init.Do(func() {
+		f.health = make(map[string]*upstreamHealth)
+		f.inflight = newInflight()
+	})
+}
+
+func (f *Forwarder) transport() Transport {
+	if f.Transport != nil {
+		return f.Transport
+	}
+	return UDPTransport{}
+}
+
+func (f *Forwarder) tcpTransport() Transport {
+	if f.TCPTransport != nil {
+		return f.TCPTransport
+	}
+	return TCPTransport{}
+}
+
+// InFlight is how many questions are being forwarded, not counting any
+// that are waiting for an identical one to be answered.
+func (f *Forwarder) InFlight() int {
+	f.setup()
+	return f.inflight.size()
+}
+
+func (f *Forwarder) logger() *slog.Logger {
+	return loggerOr(f.Logger)
+}
+
+func (f *Forwarder) Resolve(ctx context.Context, question dns.Question) (dns.Message, error) {
+	f.setup()
+	if f.Cache != nil {
+		if answers, ok := f.Cache.Get(question); ok && len(answers) > 0 {
+			f.logger().Debug("answered from cache",
+				qnameAttr(question.Name), qtypeAttr(question.Type), cacheAttr("hit"))
+			traceEvent(ctx, TraceEvent{Kind: TraceCacheHit, Question: question})
+			return dns.Message{
+				Answers: answers,
+			}, nil
+		}
+		if rcode, soa, ok := f.Cache.GetNegative(question); ok {
+			f.logger().Debug("answered from cache",
+				qnameAttr(question.Name), qtypeAttr(question.Type), rcodeAttr(rcode), cacheAttr("negative"))
+			traceEvent(ctx, TraceEvent{Kind: TraceCacheHit, Question: question, RCode: rcode})
+			return dns.Message{
+				Flags:       dns.Flags(0).WithType(dns.Response).WithResponseCode(rcode),
+				Authorities: []dns.Resource{soa},
+			}, nil
+		}
+	}
+
+	return f.inflight.do(ctx, question, func(ctx context.Context) (dns.Message, error) {
+		rsp, err := f.forward(ctx, question)
+		if err != nil || f.Cache == nil {
+			return rsp, err
+		}
+		// the upstreams aren't authoritative, and only their answers
+		// are any use to us:
+		f.Cache.Put(rsp.Answers, TrustNonAuthoritativeAnswer)
+		if soa, ok := findNegativeSOA(question, rsp); ok && len(rsp.Answers) == 0 {
+			f.Cache.PutNegative(question, rsp.Flags.ResponseCode(), soa)
+		}
+		return rsp, nil
+	})
+}
+
+// forward sends the question to the upstreams, as the strategy says, until
+// one of them answers it.
+func (f *Forwarder) forward(ctx context.Context, question dns.Question) (dns.Message, error) {
+	upstreams := f.order()
+	if len(upstreams) == 0 {
+		return dns.Message{}, errors.New("no upstreams to forward to")
+	}
+	if f.Strategy == Parallel {
+		return f.race(ctx, upstreams, question)
+	}
+
+	var errs []error
+	for _, upstream := range upstreams {
+		rsp, err := f.exchange(ctx, upstream, question)
+		if err == nil {
+			return rsp, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", upstream, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return dns.Message{}, errors.Join(errs...)
+}
+
+// race sends the question to all of the upstreams at once, and returns the
+// first response.
+func (f *Forwarder) race(ctx context.Context, upstreams []net.IP, question dns.Question) (dns.Message, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		ip  net.IP
+		rsp dns.Message
+		err error
+	}
+	results := make(chan result, len(upstreams))
+	for _, ip := range upstreams {
+		go func() {
+			rsp, err := f.exchange(ctx, ip, question)
+			results <- result{ip, rsp, err}
+		}()
+	}
+
+	var errs []error
+	for range upstreams {
+		res := <-results
+		if res.err == nil {
+			return res.rsp, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", res.ip, res.err))
+	}
+	return dns.Message{}, errors.Join(errs...)
+}
+
+// exchange sends the question to a single upstream, asking again over TCP
+// if the response is truncated, and keeps track of how it went.
+func (f *Forwarder) exchange(ctx context.Context, upstream net.IP, question dns.Question) (dns.Message, error) {
+	query := newQuery(question)
+	query.Flags = query.Flags.WithRecursionDesired(true)
+
+	start := time.Now()
+	rsp, err := exchangeTraced(ctx, f.transport(), nil, upstream, query)
+	if err == nil && rsp.Flags.Truncated() {
+		rsp, err = exchangeTraced(ctx, f.tcpTransport(), nil, upstream, query)
+	}
+	if err == nil {
+		// the transport might not have checked, and this is what
+		// every client of ours will trust:
+		err = checkResponse(query, rsp)
+	}
+	if rcode := rsp.Flags.ResponseCode(); err == nil && serverFailed(rcode) {
+		err = fmt.Errorf("%w: %s", ErrUpstreamFailed, rcode)
+	}
+
+	// being cancelled because another upstream won the race isn't the
+	// upstream's fault:
+	if ctx.Err() == nil {
+		f.record(upstream, time.Since(start), err)
+	}
+	return rsp, err
+}
+
+// order returns the upstreams that aren't in cooldown, in the order that
+// they should be tried, or all of them if they're all in cooldown.
+func (f *Forwarder) order() []net.IP {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	now := time.Now()
+	var upstreams []net.IP
+	for _, upstream := range f.Upstreams {
+		if health := f.health[upstream.String()]; health == nil || !now.Before(health.coolUntil) {
+			upstreams = append(upstreams, upstream)
+		}
+	}
+	if len(upstreams) == 0 {
+		upstreams = slices.Clone(f.Upstreams)
+	}
+
+	switch f.Strategy {
+	case Random:
+		shuffle(upstreams)
+	case Fastest:
+		// upstreams that we haven't heard from yet come first, so that
+		// we find out how fast they are:
+		slices.SortStableFunc(upstreams, func(a, b net.IP) int {
+			return int(f.rtt(a) - f.rtt(b))
+		})
+	}
+	return upstreams
+}
+
+func (f *Forwarder) rtt(upstream net.IP) time.Duration {
+	if health := f.health[upstream.String()]; health != nil {
+		return health.rtt
+	}
+	return 0
+}
+
+// record updates the health of an upstream after a query.
+func (f *Forwarder) record(upstream net.IP, rtt time.Duration, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	health := f.health[upstream.String()]
+	if health == nil {
+		health = &upstreamHealth{}
+		f.health[upstream.String()] = health
+	}
+
+	if err == nil {
+		health.failures = 0
+		health.coolUntil = time.Time{}
+		if health.rtt == 0 {
+			health.rtt = rtt
+		} else {
+			// the same smoothing as TCP, from RFC 6298
+			health.rtt = health.rtt - health.rtt/8 + rtt/8
+		}
+		return
+	}
+
+	health.failures++
+	if health.failures >= f.failureThreshold() {
+		cooldown := f.Cooldown
+		if cooldown == 0 {
+			cooldown = defaultCooldown
+		}
+		if !time.Now().Before(health.coolUntil) {
+			f.logger().Warn("upstream keeps failing, cooling down",
+				serverAttr(upstream), slog.Int("failures", health.failures),
+				slog.Duration("cooldown", cooldown), errAttr(err))
+		}
+		health.coolUntil = time.Now().Add(cooldown)
+	}
+}
+
+func (f *Forwarder) failureThreshold() int {
+	if f.FailureThreshold > 0 {
+		return f.FailureThreshold
+	}
+	return defaultFailureThreshold
+}
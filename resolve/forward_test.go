@@ -0,0 +1,170 @@
+package resolve_test
+
+import (
+	"context"
+	"dns"
+	"dns/resolve"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// transportFunc is a Transport that sees the whole query, for checking
+// its flags.
+type transportFunc func(ctx context.Context, server net.IP, query dns.Message) (dns.Message, error)
+
+func (f transportFunc) Exchange(ctx context.Context, server net.IP, query dns.Message) (dns.Message, error) {
+	return f(ctx, server, query)
+}
+
+// upstream is a fakeServer that acts as a recursive resolver, answering
+// everything from the records.
+func upstream(records ...dns.Resource) fakeServer {
+	return func(q dns.Question) dns.Message {
+		var rsp dns.Message
+		for _, rr := range records {
+			if rr.Name.Equal(q.Name) && rr.Type == q.Type {
+				rsp.Answers = append(rsp.Answers, rr)
+			}
+		}
+		return rsp
+	}
+}
+
+func servfail(q dns.Question) dns.Message {
+	return dns.Message{Flags: dns.Flags(0).WithResponseCode(dns.ServerFailure)}
+}
+
+func newTestForwarder(transport resolve.Transport, upstreams ...string) *resolve.Forwarder {
+	var addrs []net.IP
+	for _, upstream := range upstreams {
+		addrs = append(addrs, net.ParseIP(upstream))
+	}
+	f := resolve.NewForwarder(addrs...)
+	f.Transport = transport
+	f.TCPTransport = transport
+	f.Cache = nil
+	return f
+}
+
+func TestForwardAsksForRecursion(t *testing.T) {
+	www := upstream(rr("www.example.com.", dns.A, "192.0.2.1"))
+	f := newTestForwarder(transportFunc(func(ctx context.Context, server net.IP, query dns.Message) (dns.Message, error) {
+		if !query.Flags.RecursionDesired() {
+			return dns.Message{}, errors.New("expected recursion desired")
+		}
+		return www.serve(query), nil
+	}), "10.0.9.1")
+
+	rsp, err := f.Resolve(context.Background(), question("www.example.com", dns.A))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rsp.Answers) != 1 {
+		t.Errorf("expected 1 answer, got %v", rsp.Answers)
+	}
+}
+
+func TestForwarderWithoutNewForwarder(t *testing.T) {
+	f := &resolve.Forwarder{
+		Upstreams: []net.IP{net.ParseIP("10.0.9.1"), net.ParseIP("10.0.9.2")},
+		Transport: fakeNet{
+			"10.0.9.1": servfail,
+			"10.0.9.2": upstream(rr("www.example.com.", dns.A, "192.0.2.1")),
+		},
+	}
+
+	rsp, err := f.Resolve(context.Background(), question("www.example.com", dns.A))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rsp.Answers) != 1 {
+		t.Errorf("expected 1 answer, got %v", rsp.Answers)
+	}
+}
+
+func TestForwardRejectsMismatchedResponses(t *testing.T) {
+	www := upstream(rr("www.example.com.", dns.A, "192.0.2.1"))
+	f := newTestForwarder(transportFunc(func(ctx context.Context, server net.IP, query dns.Message) (dns.Message, error) {
+		rsp := www.serve(query)
+		rsp.ID++
+		return rsp, nil
+	}), "10.0.9.1")
+
+	if rsp, err := f.Resolve(context.Background(), question("www.example.com", dns.A)); !errors.Is(err, resolve.ErrMismatchedResponse) {
+		t.Errorf("expected a mismatched response error, got %v %v", rsp.Answers, err)
+	}
+}
+
+func TestForwardFailsOverAndCoolsDown(t *testing.T) {
+	n := fakeNet{
+		"10.0.9.1": servfail,
+		"10.0.9.2": upstream(rr("www.example.com.", dns.A, "192.0.2.1")),
+	}
+	var queried []string
+	f := newTestForwarder(n.record(&queried), "10.0.9.1", "10.0.9.2")
+	f.FailureThreshold = 2
+
+	for range 3 {
+		rsp, err := f.Resolve(context.Background(), question("www.example.com", dns.A))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rsp.Answers) != 1 {
+			t.Errorf("expected 1 answer, got %v", rsp.Answers)
+		}
+	}
+	if fmt.Sprint(queried) != "[10.0.9.1 10.0.9.2 10.0.9.1 10.0.9.2 10.0.9.2]" {
+		t.Errorf("expected the failing upstream to be skipped after 2 failures, asked %v", queried)
+	}
+}
+
+func TestForwardRetriesTruncatedOverTCP(t *testing.T) {
+	www := upstream(rr("www.example.com.", dns.A, "192.0.2.1"))
+	f := newTestForwarder(transportFunc(func(ctx context.Context, server net.IP, query dns.Message) (dns.Message, error) {
+		return dns.Message{Flags: dns.Flags(0).WithType(dns.Response).WithTruncated(true)}, nil
+	}), "10.0.9.1")
+	f.TCPTransport = fakeNet{"10.0.9.1": www}
+
+	rsp, err := f.Resolve(context.Background(), question("www.example.com", dns.A))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rsp.Answers) != 1 {
+		t.Errorf("expected the answer over TCP, got %v", rsp.Answers)
+	}
+}
+
+func TestForwardInParallel(t *testing.T) {
+	n := fakeNet{
+		"10.0.9.1": nil,
+		"10.0.9.2": upstream(rr("www.example.com.", dns.A, "192.0.2.1")),
+	}
+	f := newTestForwarder(n, "10.0.9.1", "10.0.9.2")
+	f.Strategy = resolve.Parallel
+
+	rsp, err := f.Resolve(context.Background(), question("www.example.com", dns.A))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rsp.Answers) != 1 {
+		t.Errorf("expected 1 answer, got %v", rsp.Answers)
+	}
+}
+
+func TestForwardCachesAnswers(t *testing.T) {
+	n := fakeNet{"10.0.9.1": upstream(rr("www.example.com.", dns.A, "192.0.2.1"))}
+	var queried []string
+	f := newTestForwarder(n.record(&queried), "10.0.9.1")
+	f.Cache, _ = newTestCache()
+
+	for range 2 {
+		if _, err := f.Resolve(context.Background(), question("www.example.com", dns.A)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(queried) != 1 {
+		t.Errorf("expected the second answer from the cache, asked %v", queried)
+	}
+}
@@ -0,0 +1,214 @@
+package resolve
+
+import (
+	"bufio"
+	"dns"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Answering from a file in /etc/hosts format, so that names can be pinned
+// to local addresses without running a zone for them.
+
+// Hosts is a table of names and addresses, from a hosts file.
+type Hosts struct {
+	// addrs are the addresses of each name, keyed by its lower case
+	// string.
+	addrs map[string][]net.IP
+	// names are the canonical names for each address, keyed by its
+	// string.
+	names map[string][]dns.Name
+}
+
+// hostsTTL is the TTL of answers from a hosts file.  It's zero, so that
+// clients notice straight away when the file changes.
+const hostsTTL = 0
+
+// ParseHosts parses a file in hosts format, where each line is an address
+// and the names that it belongs to, the first of which is its canonical
+// name.  Like the C library, it ignores anything that it doesn't
+// understand.
+func ParseHosts(r io.Reader) (*Hosts, error) {
+	hosts := &Hosts{
+		addrs: make(map[string][]net.IP),
+		names: make(map[string][]dns.Name),
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+
+		canonical := true
+		for _, field := range fields[1:] {
+			name, err := dns.ParseName(field)
+			if err != nil || len(name) == 0 {
+				continue
+			}
+			key := strings.ToLower(name.String())
+			hosts.addrs[key] = append(hosts.addrs[key], ip)
+			if canonical {
+				hosts.names[ip.String()] = append(hosts.names[ip.String()], name)
+				canonical = false
+			}
+		}
+	}
+	return hosts, scanner.Err()
+}
+
+// Lookup answers A and AAAA questions about the names in the table, and
+// PTR questions about its addresses.  A name that's in the table but only
+// has addresses of the other type has no answers, but ok is still true,
+// so that the table isn't bypassed by asking for the other type.
+func (h *Hosts) Lookup(question dns.Question) (answers []dns.Resource, ok bool) {
+	if question.Class != dns.IN {
+		return nil, false
+	}
+	switch question.Type {
+	case dns.A, dns.AAAA:
+		addrs, ok := h.addrs[strings.ToLower(question.Name.String())]
+		if !ok {
+			return nil, false
+		}
+		for _, addr := range addrs {
+			if (addr.To4() != nil) == (question.Type == dns.A) {
+				answers = append(answers, hostsRecord(question, addr))
+			}
+		}
+		return answers, true
+	case dns.PTR:
+		addr, ok := parseReverseName(question.Name)
+		if !ok {
+			return nil, false
+		}
+		names, ok := h.names[addr.String()]
+		for _, name := range names {
+			answers = append(answers, hostsRecord(question, name))
+		}
+		return answers, ok
+	default:
+		return nil, false
+	}
+}
+
+func hostsRecord(question dns.Question, data any) dns.Resource {
+	return dns.Resource{
+		Name:  question.Name,
+		Type:  question.Type,
+		Class: question.Class,
+		TTL:   hostsTTL,
+		Data:  data,
+	}
+}
+
+// parseReverseName parses the address from a name in in-addr.arpa or
+// ip6.arpa, which has the octets or nibbles of the address in reverse.
+func parseReverseName(name dns.Name) (net.IP, bool) {
+	n := len(name)
+	switch {
+	case n == 6 && strings.EqualFold(string(name[4]), "in-addr") && strings.EqualFold(string(name[5]), "arpa"):
+		ip := make(net.IP, net.IPv4len)
+		for i := range net.IPv4len {
+			octet, err := strconv.ParseUint(string(name[3-i]), 10, 8)
+			if err != nil {
+				return nil, false
+			}
+			ip[i] = byte(octet)
+		}
+		return ip, true
+	case n == 34 && strings.EqualFold(string(name[32]), "ip6") && strings.EqualFold(string(name[33]), "arpa"):
+		ip := make(net.IP, net.IPv6len)
+		for i := range 2 * net.IPv6len {
+			nibble, err := strconv.ParseUint(string(name[31-i]), 16, 4)
+			if err != nil || len(name[31-i]) != 1 {
+				return nil, false
+			}
+			ip[i/2] |= byte(nibble) << (4 * (1 - i%2))
+		}
+		return ip, true
+	default:
+		return nil, false
+	}
+}
+
+// hostsCheckInterval is how often a HostsFile checks whether it's changed.
+const hostsCheckInterval = time.Second
+
+// HostsFile is a hosts file that's reloaded whenever it changes.  It's
+// checked for changes when it's used, at most once a second.
+type HostsFile struct {
+	path string
+
+	// Logger is told when the file is reloaded, or can't be.  Defaults to
+	// slog.Default().
+	Logger *slog.Logger
+
+	mutex   sync.Mutex
+	hosts   *Hosts
+	modTime time.Time
+	size    int64
+	checked time.Time
+}
+
+// LoadHostsFile loads a hosts file, which must exist to begin with.
+func LoadHostsFile(path string) (*HostsFile, error) {
+	f := &HostsFile{path: path}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Lookup answers from the file, as Hosts.Lookup does.
+func (f *HostsFile) Lookup(question dns.Question) ([]dns.Resource, bool) {
+	f.mutex.Lock()
+	if time.Since(f.checked) >= hostsCheckInterval {
+		if err := f.reload(); err != nil {
+			loggerOr(f.Logger).Warn("couldn't reload hosts file",
+				slog.String("path", f.path), errAttr(err))
+		}
+	}
+	hosts := f.hosts
+	f.mutex.Unlock()
+	return hosts.Lookup(question)
+}
+
+// reload reads the file again, if it's changed since it was last read.  If
+// it can't be read, the old contents are kept.
+func (f *HostsFile) reload() error {
+	f.checked = time.Now()
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	if f.hosts != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return nil
+	}
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hosts, err := ParseHosts(file)
+	if err != nil {
+		return err
+	}
+	if f.hosts != nil {
+		loggerOr(f.Logger).Info("reloaded hosts file", slog.String("path", f.path))
+	}
+	f.hosts, f.modTime, f.size = hosts, info.ModTime(), info.Size()
+	return nil
+}
@@ -0,0 +1,97 @@
+package resolve_test
+
+import (
+	"dns"
+	"dns/resolve"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testHosts = `
+127.0.0.1	localhost
+::1		localhost ip6-localhost
+192.0.2.1	www.example.com www  # pinned
+2001:db8::1	www.example.com
+not-an-address	ignored.example.com
+`
+
+func TestHostsLookup(t *testing.T) {
+	hosts, err := resolve.ParseHosts(strings.NewReader(testHosts))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		question dns.Question
+		answers  string
+		ok       bool
+	}{
+		{question("www.example.com", dns.A), "[192.0.2.1]", true},
+		{question("WWW.example.com", dns.AAAA), "[2001:db8::1]", true},
+		{question("localhost", dns.A), "[127.0.0.1]", true},
+		// the name is pinned, even though it has no addresses of this
+		// type:
+		{question("ip6-localhost", dns.A), "[]", true},
+		{question("1.2.0.192.in-addr.arpa", dns.PTR), "[www.example.com]", true},
+		{question("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", dns.PTR), "[www.example.com]", true},
+		{question("2.2.0.192.in-addr.arpa", dns.PTR), "[]", false},
+		{question("www.example.com", dns.MX), "[]", false},
+		{question("ignored.example.com", dns.A), "[]", false},
+		{question("mail.example.com", dns.A), "[]", false},
+	}
+	for _, test := range tests {
+		t.Run(test.question.Name.String()+"/"+test.question.Type.String(), func(t *testing.T) {
+			answers, ok := hosts.Lookup(test.question)
+			if ok != test.ok {
+				t.Errorf("expected ok to be %t", test.ok)
+			}
+			var data []any
+			for _, answer := range answers {
+				data = append(data, answer.Data)
+			}
+			if got := fmt.Sprint(data); got != test.answers {
+				t.Errorf("expected %s, got %s", test.answers, got)
+			}
+		})
+	}
+}
+
+func TestHostsFileReloads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(path, []byte("192.0.2.1 www.example.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := resolve.LoadHostsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := question("www.example.com", dns.A)
+	if answers, _ := hosts.Lookup(q); fmt.Sprint(answers[0].Data) != "192.0.2.1" {
+		t.Fatalf("expected 192.0.2.1, got %v", answers)
+	}
+
+	if err := os.WriteFile(path, []byte("192.0.2.2 www.example.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// make sure that the change is noticed, however coarse the file
+	// system's times are:
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		answers, _ := hosts.Lookup(q)
+		if fmt.Sprint(answers[0].Data) == "192.0.2.2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the file to be reloaded, still got %v", answers)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
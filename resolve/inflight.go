@@ -0,0 +1,111 @@
+package resolve
+
+import (
+	"context"
+	"dns"
+	"sync"
+)
+
+// Coalescing identical resolutions that are in flight at the same time.
+//
+// A burst of clients asking the same uncached question would otherwise
+// start a full iterative resolution each, sending the same queries to the
+// same servers.  Instead, the first one leads and the rest wait for its
+// result.  The same goes for looking up the addresses of name servers,
+// which many resolutions can need at once.
+//
+// A resolution can need the answer to a question that it's already
+// resolving further up, as in a delegation loop, and waiting for itself
+// would never finish.  So the questions that each resolution is leading are
+// kept in its context, and those it resolves again directly, leaving the
+// budget to stop the loop as usual.  Two resolutions that wait for each
+// other from different goroutines are only stopped by running out of time.
+//
+// The leader's caller might give up before the resolution finishes, but
+// the others waiting for it might not, so it's carried on without being
+// cancelled, and each caller only waits for as long as it wants to.
+
+// inflight is a set of resolutions that are in progress.
+type inflight struct {
+	mutex sync.Mutex
+	calls map[CacheKey]*flight
+}
+
+// flight is a single resolution, which any number of callers can wait
+// for.
+type flight struct {
+	done chan struct{}
+	msg  dns.Message
+	err  error
+}
+
+func newInflight() *inflight {
+	return &inflight{calls: make(map[CacheKey]*flight)}
+}
+
+// leading is the list of questions that a resolution is leading, in its
+// context.
+type leading struct {
+	key    CacheKey
+	parent *leading
+}
+
+type leadingKey struct{}
+
+func isLeading(ctx context.Context, key CacheKey) bool {
+	for l, _ := ctx.Value(leadingKey{}).(*leading); l != nil; l = l.parent {
+		if l.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// do calls resolve for the question, unless it's already being resolved,
+// in which case it waits for that to finish and returns the same result.
+// Either way, it returns early if ctx is done, but resolve isn't cancelled.
+// The message is shared, so it mustn't be modified.
+func (f *inflight) do(ctx context.Context, question dns.Question, resolve func(context.Context) (dns.Message, error)) (dns.Message, error) {
+	key := newCacheKey(question)
+	if isLeading(ctx, key) {
+		return resolve(ctx)
+	}
+
+	f.mutex.Lock()
+	call, ok := f.calls[key]
+	if ok {
+		f.mutex.Unlock()
+		traceEvent(ctx, TraceEvent{Kind: TraceShared, Question: question})
+	} else {
+		call = &flight{done: make(chan struct{})}
+		f.calls[key] = call
+		f.mutex.Unlock()
+
+		parent, _ := ctx.Value(leadingKey{}).(*leading)
+		shared, stop := detach(ctx)
+		defer stop()
+		shared = context.WithValue(shared, leadingKey{}, &leading{key: key, parent: parent})
+		go func() {
+			call.msg, call.err = resolve(shared)
+
+			f.mutex.Lock()
+			delete(f.calls, key)
+			f.mutex.Unlock()
+			close(call.done)
+		}()
+	}
+
+	select {
+	case <-call.done:
+		return call.msg, call.err
+	case <-ctx.Done():
+		return dns.Message{}, context.Cause(ctx)
+	}
+}
+
+// size is how many resolutions are in flight.
+func (f *inflight) size() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.calls)
+}
@@ -0,0 +1,154 @@
+package resolve_test
+
+import (
+	"context"
+	"dns"
+	"dns/resolve"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gate holds up the responses from srv until release is closed.
+func gate(srv fakeServer, release <-chan struct{}) fakeServer {
+	return func(q dns.Question) dns.Message {
+		<-release
+		return srv(q)
+	}
+}
+
+// resolveConcurrently resolves each of the questions from its own
+// goroutine, giving them all time to start before releasing the servers.
+func resolveConcurrently(t *testing.T, r *resolve.Resolver, release chan struct{}, questions ...dns.Question) {
+	t.Helper()
+	var wg sync.WaitGroup
+	errs := make([]error, len(questions))
+	for i, q := range questions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = r.Resolve(context.Background(), q)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestConcurrentResolutionsAreCoalesced(t *testing.T) {
+	n := testNet()
+	release := make(chan struct{})
+	n["10.0.2.1"] = gate(n["10.0.2.1"], release)
+	var queried []string
+	r := newTestResolver(n.record(&queried))
+
+	q := question("www.example.com", dns.A)
+	resolveConcurrently(t, r, release, slices.Repeat([]dns.Question{q}, 10)...)
+
+	if count(queried, "10.0.2.1") != 1 {
+		t.Errorf("expected a single query to the example.com server, got %v", queried)
+	}
+}
+
+func TestNameServerLookupsAreCoalesced(t *testing.T) {
+	n := testNet()
+	n["10.0.0.1"] = zone(
+		rr(".", dns.NS, "a.root."),
+		rr("a.root.", dns.A, "10.0.0.1"),
+		rr("com.", dns.NS, "ns.com."),
+		rr("ns.com.", dns.A, "10.0.1.1"),
+		rr("org.", dns.NS, "ns.org."),
+		rr("ns.org.", dns.A, "10.0.3.1"),
+	)
+	// example.org is served by ns.example.com, without glue:
+	n["10.0.3.1"] = zone(
+		rr("org.", dns.NS, "ns.org."),
+		rr("example.org.", dns.NS, "ns.example.com."),
+	)
+	n["10.0.2.1"] = zone(
+		rr("example.com.", dns.NS, "ns.example.com."),
+		rr("ns.example.com.", dns.A, "10.0.2.1"),
+		rr("www.example.com.", dns.A, "192.0.2.1"),
+	)
+	release := make(chan struct{})
+	n["10.0.1.1"] = gate(n["10.0.1.1"], release)
+	var queried []string
+	r := newTestResolver(n.record(&queried))
+	r.Family = resolve.IPv4Only
+
+	resolveConcurrently(t, r, release,
+		question("www.example.org", dns.A),
+		question("mail.example.org", dns.A),
+		question("ftp.example.org", dns.A),
+	)
+
+	if count(queried, "10.0.1.1") != 1 {
+		t.Errorf("expected ns.example.com to be looked up once, got %v", queried)
+	}
+}
+
+func count(queried []string, addr string) int {
+	n := 0
+	for _, q := range queried {
+		if q == addr {
+			n++
+		}
+	}
+	return n
+}
+
+func TestCancellingTheLeaderDoesNotCancelTheOthers(t *testing.T) {
+	n := testNet()
+	release := make(chan struct{})
+	n["10.0.2.1"] = gate(n["10.0.2.1"], release)
+	r := newTestResolver(n)
+	q := question("www.example.com", dns.A)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leaderErr := make(chan error)
+	go func() {
+		_, err := r.Resolve(ctx, q)
+		leaderErr <- err
+	}()
+	for r.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	type result struct {
+		rsp dns.Message
+		err error
+	}
+	follower := make(chan result)
+	go func() {
+		rsp, err := r.Resolve(context.Background(), q)
+		follower <- result{rsp, err}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// the leader gives up without waiting for the server:
+	cancel()
+	select {
+	case err := <-leaderErr:
+		if err == nil {
+			t.Error("expected the leader to be cancelled")
+		}
+	case <-time.After(time.Second):
+		close(release)
+		t.Fatal("the leader didn't give up")
+	}
+
+	close(release)
+	res := <-follower
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if len(res.rsp.Answers) != 1 {
+		t.Errorf("expected 1 answer, got %v", res.rsp.Answers)
+	}
+}
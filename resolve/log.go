@@ -0,0 +1,54 @@
+package resolve
+
+import (
+	"dns"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// Attributes for the things that we log most often, so that they always
+// have the same keys.  Per-query messages are logged at the debug level,
+// so that they can be turned off in production.
+
+func qnameAttr(name dns.Name) slog.Attr {
+	return slog.String("qname", zoneString(name))
+}
+
+func qtypeAttr(typ dns.QueryType) slog.Attr {
+	return slog.String("qtype", typ.String())
+}
+
+func serverAttr(server net.IP) slog.Attr {
+	return slog.String("server", server.String())
+}
+
+func zoneAttr(zone dns.Name) slog.Attr {
+	return slog.String("zone", zoneString(zone))
+}
+
+func rcodeAttr(rcode dns.ResponseCode) slog.Attr {
+	return slog.String("rcode", rcode.String())
+}
+
+func durationAttr(d time.Duration) slog.Attr {
+	return slog.Duration("duration", d)
+}
+
+// cacheAttr says whether an answer came from the cache: "hit", "negative",
+// "stale" or "miss".
+func cacheAttr(status string) slog.Attr {
+	return slog.String("cache", status)
+}
+
+func errAttr(err error) slog.Attr {
+	return slog.Any("err", err)
+}
+
+// loggerOr returns logger, or the default logger if it's nil.
+func loggerOr(logger *slog.Logger) *slog.Logger {
+	if logger != nil {
+		return logger
+	}
+	return slog.Default()
+}
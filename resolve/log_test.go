@@ -0,0 +1,44 @@
+package resolve_test
+
+import (
+	"bytes"
+	"context"
+	"dns"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLoggerReceivesQueries(t *testing.T) {
+	var buf bytes.Buffer
+	r := newTestResolver(testNet())
+	r.Logger = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	q := question("www.example.com", dns.A)
+
+	for range 2 {
+		if _, err := r.Resolve(context.Background(), q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{
+		`msg=resolved qname=www.example.com qtype=A rcode=NoError`,
+		`msg="answered from cache" qname=www.example.com qtype=A cache=hit`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("expected the log to contain %s, got:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestLoggerLevels(t *testing.T) {
+	var buf bytes.Buffer
+	r := newTestResolver(testNet())
+	r.Logger = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	if _, err := r.Resolve(context.Background(), question("www.example.com", dns.A)); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "qname=") {
+		t.Errorf("expected no per-query messages at info level, got:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,120 @@
+package resolve
+
+import (
+	"context"
+	"dns"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+)
+
+// Letting code that uses Go's net.Resolver resolve names with this package
+// instead, without changing how it calls it.
+//
+// Go's own resolver can be given a function to connect to name servers
+// with.  Instead of a connection to a server, we give it one end of an
+// in-memory pipe, and answer the queries that it writes to the other end.
+// Since the pipe isn't a PacketConn, it speaks DNS over TCP, with each
+// message prefixed by its length.
+
+// Backend is anything that can resolve a question, such as a Resolver or a
+// Forwarder.
+type Backend interface {
+	Resolve(ctx context.Context, question dns.Question) (dns.Message, error)
+}
+
+// NetResolver creates a net.Resolver that resolves names with backend,
+// instead of asking the servers in resolv.conf.  It still reads
+// resolv.conf for its search list and other options, and /etc/hosts
+// before that.  Problems with the queries that it sends are logged to the
+// backend's Logger, if it has one, or slog.Default().
+func NetResolver(backend Backend) *net.Resolver {
+	logger := backendLogger(backend)
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go servePipe(ctx, backend, logger, server)
+			return client, nil
+		},
+	}
+}
+
+// backendLogger finds the logger that a Resolver or Forwarder was given.
+func backendLogger(backend Backend) *slog.Logger {
+	if backend, ok := backend.(interface{ logger() *slog.Logger }); ok {
+		return backend.logger()
+	}
+	return slog.Default()
+}
+
+// servePipe answers the queries written to conn, until it's closed.
+func servePipe(ctx context.Context, backend Backend, logger *slog.Logger, conn net.Conn) {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	for {
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		query, err := dns.ParseMessage(buf)
+		if err != nil {
+			logger.Warn("couldn't parse query from net.Resolver", errAttr(err))
+			return
+		}
+
+		rsp, err := respond(ctx, backend, logger, query).WriteTo(nil)
+		if err != nil {
+			logger.Warn("couldn't write response to net.Resolver", errAttr(err))
+			return
+		}
+		if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(rsp)))); err != nil {
+			return
+		}
+		if _, err := conn.Write(rsp); err != nil {
+			return
+		}
+	}
+}
+
+// respond resolves the question in the query with backend, and makes the
+// response to send back.
+func respond(ctx context.Context, backend Backend, logger *slog.Logger, query dns.Message) dns.Message {
+	rsp := dns.MakeResponse(query)
+	// we're a recursive resolver as far as the client is concerned, and
+	// Go's resolver treats empty responses without this as lame:
+	rsp.Flags = rsp.Flags.WithRecursionAvailable(true)
+	if len(query.Questions) != 1 {
+		rsp.Flags = rsp.Flags.WithResponseCode(dns.FormatError)
+		return rsp
+	}
+
+	question := query.Questions[0]
+	resolved, err := backend.Resolve(ctx, question)
+	if err != nil {
+		logger.Debug("couldn't resolve for net.Resolver",
+			qnameAttr(question.Name), qtypeAttr(question.Type), errAttr(err))
+		rsp.Flags = rsp.Flags.WithResponseCode(dns.ServerFailure)
+		return rsp
+	}
+
+	rsp.Flags = rsp.Flags.WithResponseCode(resolved.Flags.ResponseCode())
+	rsp.Answers = resolved.Answers
+	rsp.Authorities = resolved.Authorities
+	for _, additional := range resolved.Additional {
+		// EDNS is between us and the client, and it didn't ask for any
+		if additional.Type != dns.OPT {
+			rsp.Additional = append(rsp.Additional, additional)
+		}
+	}
+	return rsp
+}
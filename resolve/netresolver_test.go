@@ -0,0 +1,45 @@
+package resolve_test
+
+import (
+	"bytes"
+	"context"
+	"dns/resolve"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestNetResolver(t *testing.T) {
+	r := resolve.NetResolver(newTestResolver(testNet()))
+
+	addrs, err := r.LookupHost(context.Background(), "www.example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(addrs) != "[192.0.2.1]" {
+		t.Errorf("expected [192.0.2.1], got %v", addrs)
+	}
+
+	_, err = r.LookupHost(context.Background(), "nope.example.com.")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("expected not found, got %v", err)
+	}
+}
+
+func TestNetResolverLogsToBackendLogger(t *testing.T) {
+	var buf bytes.Buffer
+	f := newTestForwarder(fakeNet{"10.0.9.1": servfail}, "10.0.9.1")
+	f.Logger = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	r := resolve.NetResolver(f)
+
+	if _, err := r.LookupHost(context.Background(), "www.example.com."); err == nil {
+		t.Fatal("expected the lookup to fail")
+	}
+	if !strings.Contains(buf.String(), `msg="couldn't resolve for net.Resolver" qname=www.example.com`) {
+		t.Errorf("expected the failure in the forwarder's log, got:\n%s", buf.String())
+	}
+}
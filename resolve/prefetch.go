@@ -0,0 +1,46 @@
+package resolve
+
+import (
+	"context"
+	"dns"
+)
+
+// Prefetching popular answers before they expire.
+//
+// Without it, the first client to ask for a name after its TTL runs out
+// has to wait for us to resolve it again, which for popular names happens
+// like clockwork.  Instead, when a popular answer is nearly out of time,
+// we refresh it in the background while still answering from the cache.
+
+// defaultPrefetchMinHits is how many times an answer has to have been
+// used, by default, before it's worth prefetching.
+const defaultPrefetchMinHits = 3
+
+func (r *Resolver) prefetchMinHits() int {
+	if r.PrefetchMinHits > 0 {
+		return r.PrefetchMinHits
+	}
+	return defaultPrefetchMinHits
+}
+
+// maybePrefetch refreshes the answer to the question in the background, if
+// it's popular and close enough to expiring.
+func (r *Resolver) maybePrefetch(question dns.Question, fresh freshness) {
+	if fresh.left >= r.PrefetchThreshold || fresh.hits < r.prefetchMinHits() {
+		return
+	}
+
+	key := newCacheKey(question)
+	if !r.refreshes.startRefreshing(key) {
+		return
+	}
+	r.logger().Debug("prefetching",
+		qnameAttr(question.Name), qtypeAttr(question.Type))
+	go func() {
+		defer r.refreshes.stopRefreshing(key)
+		if _, err := r.resolveShared(context.Background(), question); err != nil {
+			r.logger().Info("couldn't prefetch",
+				qnameAttr(question.Name), qtypeAttr(question.Type), errAttr(err))
+		}
+	}()
+}
@@ -0,0 +1,66 @@
+package resolve_test
+
+import (
+	"context"
+	"dns"
+	"testing"
+	"time"
+)
+
+func TestPrefetchPopularAnswers(t *testing.T) {
+	r := newTestResolver(testNet())
+	r.PrefetchThreshold = 0.1
+	c, clock := newTestCache()
+	r.Cache = c
+	q := question("www.example.com", dns.A)
+
+	for range 4 {
+		if _, err := r.Resolve(context.Background(), q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// with 5 minutes of the hour left:
+	clock.Advance(55 * time.Minute)
+	rsp, err := r.Resolve(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Answers[0].TTL != 5*time.Minute {
+		t.Errorf("expected the cached answer, got %v", rsp.Answers)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if rs, ok := c.Get(q); ok && rs[0].TTL == time.Hour {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the answer to be prefetched")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestNoPrefetchForUnpopularAnswers(t *testing.T) {
+	var queried []string
+	r := newTestResolver(testNet().record(&queried))
+	r.PrefetchThreshold = 0.1
+	c, clock := newTestCache()
+	r.Cache = c
+	q := question("www.example.com", dns.A)
+
+	if _, err := r.Resolve(context.Background(), q); err != nil {
+		t.Fatal(err)
+	}
+	queriedBefore := len(queried)
+
+	clock.Advance(55 * time.Minute)
+	if _, err := r.Resolve(context.Background(), q); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if len(queried) != queriedBefore {
+		t.Errorf("expected no prefetch, but sent %d queries", len(queried)-queriedBefore)
+	}
+}
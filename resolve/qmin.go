@@ -0,0 +1,186 @@
+package resolve
+
+import (
+	"context"
+	"dns"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+)
+
+// QNAME minimisation, from RFC 9156.
+//
+// The servers for a zone only need to know enough of the name that we're
+// resolving to refer us to the next zone down, so that's all we ask them
+// about: one more label than the zone has, at a time, until we're referred
+// somewhere or reach the whole name.  We ask for A records, since some
+// servers handle NS queries badly.
+//
+// Some broken servers say that names don't exist when they just have no
+// records of their own (empty non-terminals), or fail in other ways when
+// asked about them.  In relaxed mode we give up on minimising and ask
+// about the whole name when that happens.  In strict mode we believe them.
+//
+// The names of name servers that we have to look up aren't minimised.
+// They're chosen by whoever sent us the referral, who could otherwise
+// make every lookup that we let them have cost several queries, and
+// they're rarely private anyway.
+
+// Minimisation says how much of a question's name is sent to the servers
+// for each zone.
+type Minimisation int
+
+const (
+	// NoMinimisation sends the whole name to every zone's servers.
+	NoMinimisation Minimisation = iota
+	// RelaxedMinimisation minimises the name, but falls back to sending
+	// the whole name when servers don't handle minimised queries.
+	RelaxedMinimisation
+	// StrictMinimisation always minimises the name, and a name that
+	// doesn't exist means that nothing below it exists either, as in
+	// RFC 8020.
+	StrictMinimisation
+)
+
+func (m Minimisation) String() string {
+	switch m {
+	case NoMinimisation:
+		return "NoMinimisation"
+	case RelaxedMinimisation:
+		return "RelaxedMinimisation"
+	case StrictMinimisation:
+		return "StrictMinimisation"
+	default:
+		return fmt.Sprintf("Minimisation(%d)", int(m))
+	}
+}
+
+// ParseMinimisation parses "off", "relaxed" or "strict".
+func ParseMinimisation(s string) (Minimisation, error) {
+	switch s {
+	case "off":
+		return NoMinimisation, nil
+	case "relaxed":
+		return RelaxedMinimisation, nil
+	case "strict":
+		return StrictMinimisation, nil
+	default:
+		return 0, fmt.Errorf("unknown QNAME minimisation mode %q", s)
+	}
+}
+
+// these are MAX_MINIMISE_COUNT and MINIMISE_ONE_LAB from RFC 9156
+const (
+	maxMinimiseCount = 10
+	minimiseOneLabel = 4
+)
+
+// minimisedLength is how many labels of name to ask about in the next
+// minimised query, when we asked about labels of them in the last one and
+// have sent count so far.  The first few queries add one label each, and
+// the rest share out what's left, so that very long names don't take too
+// many queries.
+func minimisedLength(name dns.Name, labels, count int) int {
+	if count < minimiseOneLabel {
+		return labels + 1
+	}
+	left := maxMinimiseCount - count
+	if left <= 1 {
+		return len(name)
+	}
+	return labels + max(1, (len(name)-labels)/left)
+}
+
+// resolveMinimised asks the servers for zone about as little of the
+// question's name as they need to refer us onwards, and follows the
+// referral when we get one.  If it isn't done, the servers should be
+// asked the question itself, since there's no zone cut between them and
+// the name, or in relaxed mode, since they don't handle minimised queries.
+func (r *Resolver) resolveMinimised(ctx context.Context, b *budget, zone dns.Name, serverAddrs []net.IP, question dns.Question) (dns.Message, bool, error) {
+	strict := r.QNAMEMinimisation == StrictMinimisation
+	labels := len(zone)
+	for count := 0; ; count++ {
+		labels = minimisedLength(question.Name, labels, count)
+		if labels >= len(question.Name) {
+			return dns.Message{}, false, nil
+		}
+		minimised := dns.Question{
+			Name:  question.Name[len(question.Name)-labels:],
+			Type:  dns.A,
+			Class: question.Class,
+		}
+		if r.knowsAbout(minimised) {
+			continue
+		}
+
+		raw, err := r.exchange(ctx, b, zone, serverAddrs, minimised)
+		if errors.Is(err, ErrBudgetExceeded) || ctx.Err() != nil || err != nil && strict {
+			return dns.Message{}, true, err
+		} else if err != nil {
+			r.logger().Debug("minimised query failed, asking for the whole name",
+				qnameAttr(question.Name), slog.String("minimised", minimised.Name.String()), zoneAttr(zone), errAttr(err))
+			return dns.Message{}, false, nil
+		}
+		rsp := scrub(r.logger(), zone, raw)
+		r.Cache.PutResponse(rsp)
+
+		child, servers, err := findReferral(r.logger(), zone, minimised.Name, raw)
+		if err != nil {
+			return dns.Message{}, true, err
+		}
+		if servers != nil {
+			rsp, err := r.followReferral(ctx, b, child, servers, question)
+			return rsp, true, err
+		}
+
+		rcode := rsp.Flags.ResponseCode()
+		switch {
+		case rcode == dns.NoError && rsp.Flags.Authoritative():
+			// the name is in this zone too, whether or not it has any
+			// records, so try the next label
+			if soa, ok := findNegativeSOA(minimised, rsp); ok && len(rsp.Answers) == 0 {
+				r.Cache.PutNegative(minimised, rcode, soa)
+			}
+			continue
+		case rcode == dns.NameError && strict:
+			// nothing exists below a name that doesn't exist
+			return rsp, true, nil
+		case strict:
+			return dns.Message{}, true, fmt.Errorf("minimised query for %s: %s",
+				minimised.Name, rcode)
+		default:
+			r.logger().Debug("minimised query was refused, asking for the whole name",
+				qnameAttr(question.Name), slog.String("minimised", minimised.Name.String()), zoneAttr(zone), rcodeAttr(rcode))
+			return dns.Message{}, false, nil
+		}
+	}
+}
+
+type nsLookupKey struct{}
+
+// withNSLookup returns a context for looking up the address of a name
+// server, which isn't minimised.
+func withNSLookup(ctx context.Context) context.Context {
+	return context.WithValue(ctx, nsLookupKey{}, true)
+}
+
+// minimising checks whether the names in a resolution should be minimised.
+func (r *Resolver) minimising(ctx context.Context) bool {
+	nsLookup, _ := ctx.Value(nsLookupKey{}).(bool)
+	return r.QNAMEMinimisation != NoMinimisation && !nsLookup
+}
+
+// knowsAbout checks whether we already have an authoritative answer to a
+// minimised question in the cache, so that there's no point asking it
+// again.  The answer might have come from a zone below the one that we're
+// about to ask, in which case we'll be referred there when we ask about
+// the next label instead.  It only peeks, so as not to count towards the
+// cache's stats, or the popularity of the entries.
+func (r *Resolver) knowsAbout(question dns.Question) bool {
+	if _, ok := r.Cache.getRRset(question.Name, question.Type, question.Class, TrustAnswer, readPeek); ok {
+		return true
+	}
+	rcode, _, ok := r.Cache.negative(question, readPeek)
+	return ok && rcode == dns.NoError
+}
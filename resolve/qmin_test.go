@@ -0,0 +1,122 @@
+package resolve_test
+
+import (
+	"context"
+	"dns"
+	"dns/resolve"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordQuestions wraps all of the servers in the network so that the
+// names that they're asked about are appended to asked, as "addr name".
+func (n fakeNet) recordQuestions(asked *[]string) fakeNet {
+	var mutex sync.Mutex
+	recorded := make(fakeNet, len(n))
+	for addr, srv := range n {
+		recorded[addr] = func(q dns.Question) dns.Message {
+			mutex.Lock()
+			*asked = append(*asked, fmt.Sprintf("%s %s", addr, q.Name))
+			mutex.Unlock()
+			return srv(q)
+		}
+	}
+	return recorded
+}
+
+func TestQNAMEMinimisation(t *testing.T) {
+	var asked []string
+	r := newTestResolver(testNet().recordQuestions(&asked))
+	r.QNAMEMinimisation = resolve.StrictMinimisation
+
+	if _, err := r.Resolve(context.Background(), question("www.example.com", dns.A)); err != nil {
+		t.Fatal(err)
+	}
+	// after priming, each server only sees one more label than its zone:
+	want := "10.0.0.1 , 10.0.0.1 com, 10.0.1.1 example.com, 10.0.2.1 www.example.com"
+	if got := strings.Join(asked, ", "); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestMinimisationDoesNotCountAsCacheLookups(t *testing.T) {
+	r := newTestResolver(testNet())
+	r.QNAMEMinimisation = resolve.StrictMinimisation
+
+	for _, name := range []string{"www.example.com", "mail.example.com"} {
+		if _, err := r.Resolve(context.Background(), question(name, dns.A)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// only Resolve itself should have looked, once for each name:
+	stats := r.Cache.Stats()
+	if stats.Hits+stats.Misses != 2 || stats.NegativeHits+stats.NegativeMisses != 2 {
+		t.Errorf("expected 2 lookups of each kind, got %+v", stats)
+	}
+}
+
+// entNet has an empty non-terminal at b.example.com, and an example.com
+// server that wrongly says that it doesn't exist.
+func entNet() fakeNet {
+	n := testNet()
+	example := zone(
+		rr("example.com.", dns.NS, "ns.example.com."),
+		rr("a.b.example.com.", dns.A, "192.0.2.1"),
+	)
+	n["10.0.2.1"] = func(q dns.Question) dns.Message {
+		rsp := example(q)
+		if len(rsp.Answers) == 0 && !q.Name.Equal(mustParseName("example.com")) {
+			rsp.Flags = rsp.Flags.WithResponseCode(dns.NameError)
+		}
+		return rsp
+	}
+	return n
+}
+
+func TestRelaxedMinimisationFallsBack(t *testing.T) {
+	r := newTestResolver(entNet())
+	r.QNAMEMinimisation = resolve.RelaxedMinimisation
+
+	rsp, err := r.Resolve(context.Background(), question("a.b.example.com", dns.A))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rsp.Answers) != 1 {
+		t.Errorf("expected 1 answer, got %v", rsp.Answers)
+	}
+}
+
+func TestStrictMinimisationBelievesNXDomain(t *testing.T) {
+	r := newTestResolver(entNet())
+	r.QNAMEMinimisation = resolve.StrictMinimisation
+
+	rsp, err := r.Resolve(context.Background(), question("a.b.example.com", dns.A))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rcode := rsp.Flags.ResponseCode(); rcode != dns.NameError || len(rsp.Answers) != 0 {
+		t.Errorf("expected NXDOMAIN, got %s %v", rcode, rsp.Answers)
+	}
+}
+
+func TestMinimisationOfLongNames(t *testing.T) {
+	n := testNet()
+	long := "a.b.c.d.e.f.g.h.i.j.k.l.example.com."
+	n["10.0.2.1"] = zone(
+		rr("example.com.", dns.NS, "ns.example.com."),
+		rr(long, dns.A, "192.0.2.1"),
+	)
+	var queried []string
+	r := newTestResolver(n.record(&queried))
+	r.QNAMEMinimisation = resolve.StrictMinimisation
+
+	if _, err := r.Resolve(context.Background(), question(long, dns.A)); err != nil {
+		t.Fatal(err)
+	}
+	// MAX_MINIMISE_COUNT from RFC 9156, including the whole name:
+	if got := count(queried, "10.0.2.1"); got > 10 {
+		t.Errorf("expected at most 10 queries to example.com, got %d", got)
+	}
+}
@@ -1,201 +1,450 @@
 package resolve
 
 import (
+	"context"
 	"dns"
 	"errors"
 	"fmt"
+	"log/slog"
+	"math/rand/v2"
 	"net"
-	"slices"
+	"strings"
+	"sync"
+	"time"
 )
 
-var ripeRootIP = net.ParseIP("193.0.14.129")
-var cache = NewCache()
-
-// Resolve is a very rudimentary iterative resolver.  Only for testing
+// Resolver is a very rudimentary iterative resolver.  Only for testing
 // purposes; it has many weaknesses.
+//
+// The zero value is ready to use, but NewResolver makes one with better
+// defaults.
+type Resolver struct {
+	// Transport sends queries to authoritative servers.  Defaults to UDP.
+	Transport Transport
+
+	// Family selects which kinds of addresses are used to contact
+	// name servers.
+	Family AddressFamily
+
+	// AttemptDelay is how long we wait for a response from one server
+	// before also trying the next, with HappyEyeballs.  Defaults to 250ms.
+	AttemptDelay time.Duration
+
+	// Budget limits the work done to resolve each question.
+	Budget Budget
+
+	// Cache keeps what we've learnt.  Defaults to a NewCache.
+	Cache *Cache
+
+	// StaleRefreshInterval is how long to wait after failing to resolve
+	// a question, while serving stale answers for it, before trying
+	// again.  Defaults to 30s.  Stale answers are only served if the
+	// Cache has a StaleWindow.
+	StaleRefreshInterval time.Duration
+	// StaleAnswerTimeout is how long to wait for a fresh answer, when we
+	// have a stale one, before answering with that instead.  Resolution
+	// carries on in the background.  Defaults to 1.8s.
+	StaleAnswerTimeout time.Duration
+
+	// PrefetchThreshold is the fraction of its TTL that an answer has left
+	// when we refresh it in the background, if it's been used at least
+	// PrefetchMinHits times.  Zero means never.
+	PrefetchThreshold float64
+	// PrefetchMinHits defaults to 3.
+	PrefetchMinHits int
+
+	// QNAMEMinimisation controls how much of the name in a question we
+	// send to each zone's servers.
+	QNAMEMinimisation Minimisation
+
+	// Routes send questions about particular zones to particular servers,
+	// instead of resolving them from the root.  The most specific zone
+	// wins.
+	Routes []Route
+
+	// Logger receives what the Resolver is doing, with each question's
+	// progress at the debug level.  Defaults to slog.Default().
+	Logger *slog.Logger
+
+	init      sync.Once
+	roots     *rootSet
+	refreshes *refreshState
+	inflight  *inflight
+}
+
+// NewResolver creates a Resolver that starts from the built-in root hints,
+// sends queries over UDP and minimises them in relaxed mode.
+func NewResolver() *Resolver {
+	r := &Resolver{
+		Transport:         UDPTransport{},
+		Cache:             NewCache(),
+		QNAMEMinimisation: RelaxedMinimisation,
+	}
+	r.setup()
+	return r
+}
+
+// setup makes the state that isn't configured, the first time that it's
+// needed, so that a Resolver doesn't have to come from NewResolver.
+func (r *Resolver) setup() {
+	r.init.Do(func() {
+		roots, err := ParseRootHints(strings.NewReader(defaultRootHints))
+		if err != nil {
+			panic(fmt.Sprintf("invalid built-in root hints: %s", err))
+		}
+		if r.Cache == nil {
+			r.Cache = NewCache()
+		}
+		r.roots = &rootSet{servers: roots}
+		r.refreshes = newRefreshState()
+		r.inflight = newInflight()
+	})
+}
+
+func (r *Resolver) transport() Transport {
+	if r.Transport != nil {
+		return r.Transport
+	}
+	return UDPTransport{}
+}
+
+var defaultResolver = NewResolver()
+
+// Resolve resolves the question with a default Resolver.
 func Resolve(question dns.Question) (dns.Message, error) {
-	answers, ok := cache.Get(question)
+	return defaultResolver.Resolve(context.Background(), question)
+}
+
+func (r *Resolver) logger() *slog.Logger {
+	return loggerOr(r.Logger)
+}
+
+func (r *Resolver) Resolve(ctx context.Context, question dns.Question) (dns.Message, error) {
+	r.setup()
+	answers, fresh, ok := r.Cache.lookup(question)
 	if ok && len(answers) > 0 {
-		fmt.Printf("%s/%s? -> cache hit on query\n",
-			question.Name, question.Type)
+		r.logger().Debug("answered from cache",
+			qnameAttr(question.Name), qtypeAttr(question.Type), cacheAttr("hit"))
+		r.maybePrefetch(question, fresh)
+		traceEvent(ctx, TraceEvent{Kind: TraceCacheHit, Question: question})
 
 		// TODO: this is horrible!
-		// - are we sure the cache has answers?
 		// - we shouldn't be faking the rest of the message?
 		return dns.Message{
 			Answers: answers,
 		}, nil
 	}
 
-	msg, err := resolve(ripeRootIP, question)
+	if rcode, soa, ok := r.Cache.GetNegative(question); ok {
+		r.logger().Debug("answered from cache",
+			qnameAttr(question.Name), qtypeAttr(question.Type), rcodeAttr(rcode), cacheAttr("negative"))
+		traceEvent(ctx, TraceEvent{Kind: TraceCacheHit, Question: question, RCode: rcode})
+		return dns.Message{
+			Flags:       dns.Flags(0).WithType(dns.Response).WithResponseCode(rcode),
+			Authorities: []dns.Resource{soa},
+		}, nil
+	}
+
+	key := newCacheKey(question)
+	if r.refreshes.recentlyFailed(key, r.staleRefreshInterval()) {
+		if msg, ok := r.serveStale(question); ok {
+			traceEvent(ctx, TraceEvent{Kind: TraceStale, Question: question})
+			return msg, nil
+		}
+	}
+
+	start := time.Now()
+	msg, err := r.resolveOrStale(ctx, question, key)
 	if err != nil {
+		if stale, ok := r.serveStale(question); ok {
+			r.logger().Warn("couldn't resolve, serving stale answer",
+				qnameAttr(question.Name), qtypeAttr(question.Type), errAttr(err))
+			r.refreshes.fail(key)
+			traceEvent(ctx, TraceEvent{Kind: TraceStale, Question: question})
+			return stale, nil
+		}
+		r.logger().Debug("couldn't resolve",
+			qnameAttr(question.Name), qtypeAttr(question.Type), durationAttr(time.Since(start)), errAttr(err))
 		return msg, err
 	}
+	r.logger().Debug("resolved",
+		qnameAttr(question.Name), qtypeAttr(question.Type), rcodeAttr(msg.Flags.ResponseCode()),
+		durationAttr(time.Since(start)), cacheAttr("miss"))
+	return msg, nil
+}
 
-	// - are the answers always the correct thing to cache?
-	// - what if there are no answers, but there are other
-	//   resources?
-	// - cache the whole message instead?
-	fmt.Printf("%s/%s? -> cached %d answers\n",
-		question.Name, question.Type, len(msg.Answers))
-	cache.Put(question, msg.Answers)
-	return msg, err
+// InFlight is how many resolutions are in progress, not counting any that
+// are waiting for an identical one to finish.  That includes looking up
+// the addresses of name servers.
+func (r *Resolver) InFlight() int {
+	r.setup()
+	return r.inflight.size()
 }
 
-func resolve(serverIP net.IP, question dns.Question) (dns.Message, error) {
-	rsp, err := query(serverIP, question)
+// resolveShared resolves the question like resolveFresh, but shares the
+// result with anything else that's resolving it at the same time.
+func (r *Resolver) resolveShared(ctx context.Context, question dns.Question) (dns.Message, error) {
+	return r.inflight.do(ctx, question, func(ctx context.Context) (dns.Message, error) {
+		return r.resolveFresh(ctx, question)
+	})
+}
+
+// resolveFresh resolves the question without looking in the cache first,
+// although the cache is still used to find the closest servers.
+func (r *Resolver) resolveFresh(ctx context.Context, question dns.Question) (dns.Message, error) {
+	b := newBudget(r.Budget)
+	ctx, cancel := b.withDeadline(ctx)
+	defer cancel()
+
+	msg, err := r.resolveChain(ctx, b, question)
 	if err != nil {
-		return dns.Message{}, err
+		if cause := context.Cause(ctx); errors.Is(cause, ErrBudgetExceeded) {
+			// whatever failed, it was because we ran out of time
+			err = cause
+		}
+		return msg, err
 	}
 
-	answers := findAnswers(question.Name, rsp)
-	for _, answer := range answers {
-		if answer.Type == question.Type {
-			// TODO: put this check up in findAnswers
-			return rsp, nil
-		}
+	// the answers were cached as they arrived, but we need the question
+	// to know what doesn't exist:
+	if soa, ok := findNegativeSOA(question, msg); ok && len(msg.Answers) == 0 {
+		r.logger().Debug("caching negative answer",
+			qnameAttr(question.Name), qtypeAttr(question.Type), rcodeAttr(msg.Flags.ResponseCode()))
+		r.Cache.PutNegative(question, msg.Flags.ResponseCode(), soa)
+	}
+	return msg, err
+}
 
-		// hmm, I bet you can maliciously have CNAMEs pointing at each other?
-		if cname, ok := answer.Data.(dns.Name); ok && answer.Type == dns.CNAME {
-			// TODO: check to see if the name is already in the response
-			rsp, err := resolve(ripeRootIP, dns.Question{
-				Name:  cname,
-				Type:  question.Type,
-				Class: question.Class,
-			})
-			if err != nil {
-				return dns.Message{}, err
-			}
-			// typically servers will return the cname record first
-			// so we should probably do that too?
-			rsp.Answers = append(rsp.Answers, answer)
-			return rsp, nil
+// findNegativeSOA finds the SOA record in a response that says that the
+// question has no answers, which tells us how long that's true for.
+// Without one, the response can't be cached (RFC 2308).
+func findNegativeSOA(question dns.Question, rsp dns.Message) (dns.Resource, bool) {
+	rcode := rsp.Flags.ResponseCode()
+	if rcode != dns.NoError && rcode != dns.NameError {
+		return dns.Resource{}, false
+	}
+	for _, authority := range rsp.Authorities {
+		if authority.Type == dns.SOA && inBailiwick(question.Name, authority.Name) {
+			return authority, true
 		}
 	}
+	return dns.Resource{}, false
+}
 
-	nextServerName, nextServerIP := findAnAuthoritativeServer(rsp)
-	if nextServerIP != nil {
-		// a malicious server could also send us into infinite recursion here...
-		return resolve(nextServerIP, question)
-	}
+// rootAddrs returns the addresses of the root servers, in the order that
+// they should be tried.
+func (r *Resolver) rootAddrs() []net.IP {
+	return r.addrsOf(r.roots.get())
+}
 
-	if nextServerName != nil {
-		rsp, err := resolve(ripeRootIP, dns.Question{
-			Name:  nextServerName,
-			Type:  dns.A, // should try AAAA?
-			Class: dns.IN,
-		})
-		if err != nil {
-			return dns.Message{}, err
+// delegation is a zone, and the addresses of its servers in the order that
+// they should be tried.
+type delegation struct {
+	zone  dns.Name
+	addrs []net.IP
+}
+
+// delegations finds the zones above name whose servers we know the
+// addresses of, from referrals that we've cached, so that we don't have to
+// start from the root every time.  The closest zone comes first, and the
+// root is always last, unless name is in a stub zone, which takes its
+// place.
+func (r *Resolver) delegations(name dns.Name) []delegation {
+	route, routed := r.route(name)
+	var delegations []delegation
+	for i := range name {
+		zone := name[i:]
+		if routed && len(zone) <= len(route.Zone) {
+			break
 		}
-		answers := findAnswers(nextServerName, rsp)
-		for _, answer := range answers {
-			if ip, ok := answer.Data.(net.IP); ok && answer.Type == dns.A {
-				return resolve(ip, question)
-			}
+		servers, ok := r.Cache.NameServers(zone)
+		if !ok {
+			continue
+		}
+		if addrs := r.addrsOf(servers); len(addrs) > 0 {
+			delegations = append(delegations, delegation{zone, addrs})
 		}
 	}
-
-	return rsp, errors.New("could not find authoritative server")
+	if routed {
+		return append(delegations, delegation{route.Zone, r.Family.order(route.Servers)})
+	}
+	return append(delegations, delegation{dns.Name{}, r.rootAddrs()})
 }
 
-// TODO: multiple questions?
-// Eg, A and AAAA records
-func query(serverIP net.IP, question dns.Question) (dns.Message, error) {
-	// idea for a test framework:
-	// - instrument this to capture each query/response and write it to json
-	// - replace this with a dummy that returns data from the json
+// resolveFromClosest resolves the question from the closest zone that we
+// know the servers for.  If they fail us, perhaps because the zone has
+// moved since we cached its servers, we try again further up the tree.
+//
+// Questions about forwarded zones are handed over to their Forwarder.
+func (r *Resolver) resolveFromClosest(ctx context.Context, b *budget, question dns.Question) (dns.Message, error) {
+	route, routed := r.route(question.Name)
+	if routed && route.Forwarder != nil {
+		return r.forward(ctx, b, route, question)
+	} else if !routed {
+		r.primeIfNecessary(ctx)
+	}
 
-	query := dns.Message{
-		ID:        123, // TODO: better id!!!
-		Flags:     dns.Flags(0).WithType(dns.Query),
-		Questions: []dns.Question{question},
+	var errs []error
+	for _, d := range r.delegations(question.Name) {
+		rsp, err := r.resolve(ctx, b, d.zone, d.addrs, question)
+		if err == nil {
+			return rsp, nil
+		}
+		if errors.Is(err, ErrBudgetExceeded) || ctx.Err() != nil {
+			return dns.Message{}, err
+		}
+		r.logger().Debug("couldn't resolve from zone, trying further up",
+			qnameAttr(question.Name), qtypeAttr(question.Type), zoneAttr(d.zone), errAttr(err))
+		errs = append(errs, err)
 	}
+	return dns.Message{}, errors.Join(errs...)
+}
 
-	buf, err := query.WriteTo(nil)
+// forward resolves the question with the route's Forwarder, and caches the
+// answers.  The upstreams are only trusted for the route's zone, like any
+// other servers, so anything else in the response is removed, and any
+// chain that leads out of the zone is followed by resolveChain instead.
+func (r *Resolver) forward(ctx context.Context, b *budget, route Route, question dns.Question) (dns.Message, error) {
+	if err := b.query(); err != nil {
+		return dns.Message{}, err
+	}
+	r.logger().Debug("forwarding",
+		qnameAttr(question.Name), qtypeAttr(question.Type), zoneAttr(route.Zone))
+	traceEvent(ctx, TraceEvent{Kind: TraceForward, Question: question, Zone: route.Zone})
+	rsp, err := route.Forwarder.Resolve(ctx, question)
 	if err != nil {
-		return dns.Message{}, fmt.Errorf("couldn't serialize query: %s", err)
+		return dns.Message{}, err
 	}
+	rsp = scrub(r.logger(), route.Zone, rsp)
+	r.Cache.Put(rsp.Answers, TrustNonAuthoritativeAnswer)
+	return rsp, nil
+}
 
-	serverAddr := &net.UDPAddr{
-		IP:   serverIP,
-		Port: 53,
+// resolve answers the question by asking the servers for zone, and
+// following any referrals that they send us.
+func (r *Resolver) resolve(ctx context.Context, b *budget, zone dns.Name, serverAddrs []net.IP, question dns.Question) (dns.Message, error) {
+	if r.minimising(ctx) {
+		rsp, done, err := r.resolveMinimised(ctx, b, zone, serverAddrs, question)
+		if done {
+			return rsp, err
+		}
 	}
 
-	conn, err := net.DialUDP("udp", nil, serverAddr)
+	raw, err := r.exchange(ctx, b, zone, serverAddrs, question)
 	if err != nil {
-		return dns.Message{}, fmt.Errorf("couldn't dial root server: %s", err)
+		return dns.Message{}, err
 	}
+	rsp := scrub(r.logger(), zone, raw)
+	r.Cache.PutResponse(rsp)
 
-	n, err := conn.Write(buf)
-	if err != nil {
-		return dns.Message{}, fmt.Errorf("unable to write udp message: %s", err)
-	} else if n < len(buf) {
-		return dns.Message{}, fmt.Errorf("wrote only %d bytes of %d byte message", n, len(buf))
+	if hasAnswer(question, rsp.Answers) {
+		// any CNAMEs or DNAMEs will be followed by resolveChain
+		return rsp, nil
 	}
 
-	rspBuf := make([]byte, 1024)
-	n, err = conn.Read(rspBuf)
+	// look at the unscrubbed response, so that we notice if we're being
+	// sent somewhere that we shouldn't go:
+	child, servers, err := findReferral(r.logger(), zone, question.Name, raw)
 	if err != nil {
-		return dns.Message{}, fmt.Errorf("couldn't read udp message: %s", err)
+		return dns.Message{}, err
+	}
+	if servers == nil {
+		if rsp.Flags.Authoritative() || rsp.Flags.ResponseCode() == dns.NameError {
+			// the name or type doesn't exist
+			return rsp, nil
+		}
+		return rsp, errors.New("could not find authoritative server")
 	}
 
-	// TODO: validate the msg ID
-	return dns.ParseMessage(rspBuf[:n])
+	return r.followReferral(ctx, b, child, servers, question)
 }
 
-func findAnswers(name dns.Name, rsp dns.Message) []dns.Resource {
-	var answers []dns.Resource
-	for _, answer := range rsp.Answers {
-		// aside from malicious responses, is there a reason that we'd get
-		// non-matching answers in a response?
-		if slices.Equal(answer.Name, name) {
-			answers = append(answers, answer)
-		}
+// followReferral resolves the question from the servers for the child zone
+// that we've been referred to, looking up their addresses if we have to.
+func (r *Resolver) followReferral(ctx context.Context, b *budget, child dns.Name, servers []NameServer, question dns.Question) (dns.Message, error) {
+	if err := b.referral(); err != nil {
+		return dns.Message{}, err
 	}
-	return answers
-}
+	traceEvent(ctx, TraceEvent{Kind: TraceReferral, Question: question, Target: child})
 
-func findAnAuthoritativeServer(rsp dns.Message) (dns.Name, net.IP) {
-	for _, authority := range rsp.Authorities {
-		if authority.Type != dns.NS {
+	if addrs := r.addrsOf(servers); len(addrs) > 0 {
+		return r.resolve(ctx, b, child, addrs, question)
+	}
+
+	// Oh, we might get authorities with no ip address for them!
+	// Eg, the "de" authoritative servers know that ns1.google.com is
+	// an authority for google.de, but they don't know the ip address
+	// of ns1.google.com because it's in a different zone!
+	for _, server := range servers {
+		if inBailiwick(server.Name, child) {
+			// we'd need to ask the zone's own servers, which is what we're
+			// trying to find:
 			continue
 		}
-
-		authorityName, ok := authority.Data.(dns.Name)
-		if !ok {
+		if err := b.nsLookup(); err != nil {
+			return dns.Message{}, err
+		}
+		traceEvent(ctx, TraceEvent{Kind: TraceNSLookup, Question: question, Zone: child, Target: server.Name})
+		addrs, err := r.lookupAddrs(ctx, b, server.Name)
+		if errors.Is(err, ErrBudgetExceeded) {
+			return dns.Message{}, err
+		} else if err != nil {
+			r.logger().Debug("couldn't find name server's address",
+				qnameAttr(question.Name), zoneAttr(child), slog.String("server", server.Name.String()), errAttr(err))
 			continue
 		}
+		if len(addrs) > 0 {
+			return r.resolve(ctx, b, child, addrs, question)
+		}
+	}
 
-		// TODO: make sure that the authority is an authority for the domain
-		// or some parent zone of our actual target.
-		// But is there any reason, aside from malicious responses, that we'd
-		// get unrelated authorities here?
-
-		for _, additional := range rsp.Additional {
-			// TODO: support AAAA as well
-			// For now we probably need to prefer A at least, since I don't have
-			// a v6 address to test from!
-			if additional.Type != dns.A {
-				continue
-			}
-
-			if !slices.Equal(authorityName, additional.Name) {
-				continue
-			}
+	return dns.Message{}, errors.New("could not find authoritative server")
+}
 
-			if ip, ok := additional.Data.(net.IP); ok {
-				fmt.Printf("..authority: %s, %s, %s\n",
-					authority.Name, authorityName, ip)
-				return authorityName, ip
+// lookupAddrs finds the addresses of a name server by resolving its name
+// from the root, in whichever address families we're allowed to use.
+func (r *Resolver) lookupAddrs(ctx context.Context, b *budget, name dns.Name) ([]net.IP, error) {
+	ctx = withNSLookup(ctx)
+	var addrs []net.IP
+	var errs []error
+	for _, typ := range r.Family.queryTypes() {
+		question := dns.Question{
+			Name:  name,
+			Type:  typ,
+			Class: dns.IN,
+		}
+		rsp, err := r.inflight.do(ctx, question, func(ctx context.Context) (dns.Message, error) {
+			// the lookup isn't cancelled along with us, but it's still
+			// part of our budget:
+			ctx, cancel := b.withDeadline(ctx)
+			defer cancel()
+			return r.resolveChain(ctx, b, question)
+		})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, answer := range rsp.Answers {
+			if ip, ok := answer.Data.(net.IP); ok && answer.Type == typ {
+				addrs = append(addrs, ip)
 			}
 		}
-		// Oh, we might get an authority with no ip address in it!
-		// Eg, the "de" authoritative servers know that ns1.google.com is
-		// an authority for google.de, but they don't know the ip address
-		// of ns1.google.com because it's in a different zone!
-		fmt.Printf("..authority: %s, %s, ??\n", authority.Name, authorityName)
-		return authorityName, nil
 	}
-	return nil, nil
+	if len(addrs) == 0 && len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return r.Family.order(addrs), nil
+}
+
+// TODO: multiple questions?
+// Eg, A and AAAA records
+//
+// The ID is random, so that anyone who wants to forge a response has to
+// guess it as well as our port.
+func newQuery(question dns.Question) dns.Message {
+	return dns.Message{
+		ID:        uint16(rand.Uint32()),
+		Flags:     dns.Flags(0).WithType(dns.Query),
+		Questions: []dns.Question{question},
+	}
 }
@@ -0,0 +1,385 @@
+package resolve_test
+
+import (
+	"context"
+	"dns"
+	"dns/resolve"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNet is a Transport that sends queries to in-memory servers,
+// keyed by ip address.  A nil server never responds.
+type fakeNet map[string]fakeServer
+
+// fakeServer produces a response to a question.  The id, type and
+// questions of the response are filled in automatically.
+type fakeServer func(q dns.Question) dns.Message
+
+func (n fakeNet) Exchange(ctx context.Context, server net.IP, query dns.Message) (dns.Message, error) {
+	srv, ok := n[server.String()]
+	if !ok {
+		return dns.Message{}, fmt.Errorf("no route to host %s", server)
+	}
+	if srv == nil {
+		<-ctx.Done()
+		return dns.Message{}, ctx.Err()
+	}
+	return srv.serve(query), nil
+}
+
+func (srv fakeServer) serve(query dns.Message) dns.Message {
+	rsp := srv(query.Questions[0])
+	rsp.ID = query.ID
+	rsp.Flags = rsp.Flags.WithType(dns.Response)
+	rsp.Questions = query.Questions
+	return rsp
+}
+
+// record wraps all of the servers in the network so that the addresses
+// that are queried are appended to queried.
+func (n fakeNet) record(queried *[]string) fakeNet {
+	var mutex sync.Mutex
+	recorded := make(fakeNet, len(n))
+	for addr, srv := range n {
+		if srv == nil {
+			recorded[addr] = nil
+			continue
+		}
+		recorded[addr] = func(q dns.Question) dns.Message {
+			mutex.Lock()
+			*queried = append(*queried, addr)
+			mutex.Unlock()
+			return srv(q)
+		}
+	}
+	return recorded
+}
+
+// zone is a fakeServer that answers authoritatively from a list of
+// records.  Questions below any delegations get a referral, with glue if
+// it's in the list.  CNAMEs and DNAMEs are returned as answers, but not
+// followed.
+func zone(records ...dns.Resource) fakeServer {
+	return func(q dns.Question) dns.Message {
+		var rsp dns.Message
+		for _, rr := range records {
+			if rr.Name.Equal(q.Name) && (rr.Type == q.Type || rr.Type == dns.CNAME) &&
+				!isDelegation(records, rr) ||
+				rr.Type == dns.DNAME && q.Name.IsSubdomainOf(rr.Name) {
+				rsp.Answers = append(rsp.Answers, rr)
+			}
+		}
+		if len(rsp.Answers) > 0 {
+			rsp.Flags = rsp.Flags.WithAuthoritiative(true)
+			return rsp
+		}
+
+		for _, rr := range records {
+			if isDelegation(records, rr) && (rr.Name.Equal(q.Name) || q.Name.IsSubdomainOf(rr.Name)) {
+				rsp.Authorities = append(rsp.Authorities, rr)
+				for _, glue := range records {
+					if glue.Name.Equal(rr.Data.(dns.Name)) &&
+						(glue.Type == dns.A || glue.Type == dns.AAAA) {
+						rsp.Additional = append(rsp.Additional, glue)
+					}
+				}
+			}
+		}
+		if len(rsp.Authorities) == 0 {
+			rsp.Flags = rsp.Flags.WithAuthoritiative(true)
+		}
+		return rsp
+	}
+}
+
+// isDelegation checks whether rr is an NS record for a zone below the
+// apex of the given records, which is the owner of the first record.
+func isDelegation(records []dns.Resource, rr dns.Resource) bool {
+	return rr.Type == dns.NS && !rr.Name.Equal(records[0].Name)
+}
+
+func rr(name string, typ dns.QueryType, data any) dns.Resource {
+	if s, ok := data.(string); ok {
+		switch typ {
+		case dns.A, dns.AAAA:
+			data = net.ParseIP(s)
+		default:
+			data = mustParseName(s)
+		}
+	}
+	return dns.Resource{
+		Name:  mustParseName(name),
+		Type:  typ,
+		Class: dns.IN,
+		TTL:   time.Hour,
+		Data:  data,
+	}
+}
+
+func mustParseName(s string) dns.Name {
+	name, err := dns.ParseName(s)
+	if err != nil {
+		panic(err)
+	}
+	return name
+}
+
+func question(name string, typ dns.QueryType) dns.Question {
+	return dns.Question{
+		Name:  mustParseName(name),
+		Type:  typ,
+		Class: dns.IN,
+	}
+}
+
+// testNet is a small internet with a root, the com zone and example.com.
+func testNet() fakeNet {
+	return fakeNet{
+		"10.0.0.1": zone(
+			rr(".", dns.NS, "a.root."),
+			rr("a.root.", dns.A, "10.0.0.1"),
+			rr("com.", dns.NS, "ns.com."),
+			rr("ns.com.", dns.A, "10.0.1.1"),
+		),
+		"10.0.1.1": zone(
+			rr("com.", dns.NS, "ns.com."),
+			rr("example.com.", dns.NS, "ns.example.com."),
+			rr("ns.example.com.", dns.A, "10.0.2.1"),
+		),
+		"10.0.2.1": zone(
+			rr("example.com.", dns.NS, "ns.example.com."),
+			rr("www.example.com.", dns.A, "192.0.2.1"),
+		),
+	}
+}
+
+// newTestResolver creates a resolver that uses the given transport, with
+// a single root server at 10.0.0.1, or at the given addresses.
+func newTestResolver(transport resolve.Transport, rootAddrs ...string) *resolve.Resolver {
+	if len(rootAddrs) == 0 {
+		rootAddrs = []string{"10.0.0.1"}
+	}
+	root := resolve.NameServer{Name: mustParseName("a.root.")}
+	for _, addr := range rootAddrs {
+		root.Addrs = append(root.Addrs, net.ParseIP(addr))
+	}
+	r := resolve.NewResolver()
+	r.Transport = transport
+	r.SetRootHints([]resolve.NameServer{root})
+	return r
+}
+
+func TestResolveThroughReferrals(t *testing.T) {
+	r := newTestResolver(testNet())
+	rsp, err := r.Resolve(context.Background(), question("www.example.com", dns.A))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rsp.Answers) != 1 {
+		t.Fatalf("expected 1 answer, got %d", len(rsp.Answers))
+	}
+	ip, _ := rsp.Answers[0].Data.(net.IP)
+	if !ip.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("expected 192.0.2.1, got %s", rsp.Answers[0].Data)
+	}
+}
+
+func TestZeroValueResolver(t *testing.T) {
+	r := &resolve.Resolver{Transport: testNet()}
+	r.SetRootHints([]resolve.NameServer{{
+		Name:  mustParseName("a.root."),
+		Addrs: []net.IP{net.ParseIP("10.0.0.1")},
+	}})
+	rsp, err := r.Resolve(context.Background(), question("www.example.com", dns.A))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rsp.Answers) != 1 {
+		t.Errorf("expected 1 answer, got %v", rsp.Answers)
+	}
+	if r.InFlight() != 0 {
+		t.Errorf("expected nothing in flight, got %d", r.InFlight())
+	}
+}
+
+func namesOf(servers []resolve.NameServer) []string {
+	var names []string
+	for _, server := range servers {
+		names = append(names, server.Name.String())
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestResolveUsesCacheUntilExpiry(t *testing.T) {
+	var queried []string
+	r := newTestResolver(testNet().record(&queried))
+	c, clock := newTestCache()
+	r.Cache = c
+	q := question("www.example.com", dns.A)
+
+	if _, err := r.Resolve(context.Background(), q); err != nil {
+		t.Fatal(err)
+	}
+	queriedBefore := len(queried)
+
+	clock.Advance(time.Hour - time.Second)
+	rsp, err := r.Resolve(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queried) != queriedBefore {
+		t.Errorf("expected an answer from the cache, but sent %d more queries",
+			len(queried)-queriedBefore)
+	}
+	if len(rsp.Answers) != 1 || rsp.Answers[0].TTL != time.Second {
+		t.Errorf("expected one answer with 1s left, got %v", rsp.Answers)
+	}
+
+	clock.Advance(time.Second)
+	if _, err := r.Resolve(context.Background(), q); err != nil {
+		t.Fatal(err)
+	}
+	if len(queried) == queriedBefore {
+		t.Error("expected the answer to have expired from the cache")
+	}
+}
+
+func TestResolveCachesNXDomain(t *testing.T) {
+	n := testNet()
+	example := zone(rr("example.com.", dns.NS, "ns.example.com."))
+	n["10.0.2.1"] = func(q dns.Question) dns.Message {
+		rsp := example(q)
+		if q.Name.Equal(mustParseName("nope.example.com.")) {
+			rsp.Flags = rsp.Flags.WithResponseCode(dns.NameError)
+			rsp.Authorities = []dns.Resource{{
+				Name:  mustParseName("example.com."),
+				Type:  dns.SOA,
+				Class: dns.IN,
+				TTL:   time.Hour,
+				Data:  dns.SOARecord{MinTTL: time.Minute},
+			}}
+		}
+		return rsp
+	}
+	var queried []string
+	r := newTestResolver(n.record(&queried))
+
+	for range 2 {
+		rsp, err := r.Resolve(context.Background(), question("nope.example.com", dns.A))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rcode := rsp.Flags.ResponseCode(); rcode != dns.NameError {
+			t.Errorf("expected NXDOMAIN, got %s", rcode)
+		}
+		if len(rsp.Authorities) != 1 || rsp.Authorities[0].Type != dns.SOA {
+			t.Errorf("expected the SOA in the authority section, got %v", rsp.Authorities)
+		}
+	}
+	queries := len(queried)
+
+	if _, err := r.Resolve(context.Background(), question("nope.example.com", dns.AAAA)); err != nil {
+		t.Fatal(err)
+	}
+	if len(queried) != queries {
+		t.Errorf("expected NXDOMAIN to be served from the cache for AAAA, got %v", queried[queries:])
+	}
+}
+
+func TestResolveStartsAtCachedDelegation(t *testing.T) {
+	n := testNet()
+	n["10.0.2.1"] = zone(
+		rr("example.com.", dns.NS, "ns.example.com."),
+		rr("www.example.com.", dns.A, "192.0.2.1"),
+		rr("mail.example.com.", dns.A, "192.0.2.2"),
+	)
+	var queried []string
+	r := newTestResolver(n.record(&queried))
+
+	if _, err := r.Resolve(context.Background(), question("www.example.com", dns.A)); err != nil {
+		t.Fatal(err)
+	}
+	queried = nil
+	if _, err := r.Resolve(context.Background(), question("mail.example.com", dns.A)); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(queried) != "[10.0.2.1]" {
+		t.Errorf("expected to only ask the example.com server, asked %v", queried)
+	}
+}
+
+func TestResolveFallsBackWhenCachedDelegationFails(t *testing.T) {
+	n := testNet()
+	var queried []string
+	r := newTestResolver(n.record(&queried))
+	if _, err := r.Resolve(context.Background(), question("www.example.com", dns.A)); err != nil {
+		t.Fatal(err)
+	}
+
+	// example.com moves to a new server, but we still have the old one
+	// cached:
+	n["10.0.1.1"] = zone(
+		rr("com.", dns.NS, "ns.com."),
+		rr("example.com.", dns.NS, "ns.example.com."),
+		rr("ns.example.com.", dns.A, "10.0.2.2"),
+	)
+	n["10.0.2.2"] = zone(
+		rr("example.com.", dns.NS, "ns.example.com."),
+		rr("mail.example.com.", dns.A, "192.0.2.2"),
+	)
+	delete(n, "10.0.2.1")
+	queried = nil
+	r.Transport = n.record(&queried)
+
+	rsp, err := r.Resolve(context.Background(), question("mail.example.com", dns.A))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rsp.Answers) != 1 {
+		t.Errorf("expected 1 answer, got %v", rsp.Answers)
+	}
+	if fmt.Sprint(queried) != "[10.0.1.1 10.0.2.2]" {
+		t.Errorf("expected to fall back to the com server, asked %v", queried)
+	}
+
+	// and the new server is remembered:
+	queried = nil
+	if _, err := r.Resolve(context.Background(), question("mail.example.com", dns.AAAA)); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(queried) != "[10.0.2.2]" {
+		t.Errorf("expected to only ask the new example.com server, asked %v", queried)
+	}
+}
+
+func TestResolveTriesAnotherServerAfterSERVFAIL(t *testing.T) {
+	n := testNet()
+	n["10.0.1.1"] = zone(
+		rr("com.", dns.NS, "ns.com."),
+		rr("example.com.", dns.NS, "ns1.example.com."),
+		rr("example.com.", dns.NS, "ns2.example.com."),
+		rr("ns1.example.com.", dns.A, "10.0.2.1"),
+		rr("ns2.example.com.", dns.A, "10.0.2.2"),
+	)
+	n["10.0.2.2"] = n["10.0.2.1"]
+	n["10.0.2.1"] = servfail
+
+	// the servers are tried in a random order, so make sure that we
+	// sometimes start with the broken one:
+	for range 20 {
+		r := newTestResolver(n)
+		rsp, err := r.Resolve(context.Background(), question("www.example.com", dns.A))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rsp.Answers) != 1 {
+			t.Errorf("expected 1 answer, got %v", rsp.Answers)
+		}
+	}
+}
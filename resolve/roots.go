@@ -0,0 +1,261 @@
+package resolve
+
+import (
+	"bufio"
+	"context"
+	"dns"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultRootHints is a copy of https://www.internic.net/domain/named.root
+//
+//go:embed named.root
+var defaultRootHints string
+
+// NameServer is a server that is authoritative for some zone, along with
+// whatever addresses we know for it.
+type NameServer struct {
+	Name  dns.Name
+	Addrs []net.IP
+}
+
+func (ns NameServer) String() string {
+	return fmt.Sprintf("%s %s", ns.Name, ns.Addrs)
+}
+
+// ParseRootHints reads a list of root servers in the format of named.root.
+//
+// Only NS records for the root and A / AAAA records for those name servers
+// are understood.  Servers without any addresses are ignored, since we'd
+// have no way to find them.
+func ParseRootHints(r io.Reader) ([]NameServer, error) {
+	var names []dns.Name
+	addrs := make(map[string][]net.IP)
+
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line, _, _ := strings.Cut(scanner.Text(), ";")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		owner, err := dns.ParseName(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid name %q: %w", lineNum, fields[0], err)
+		}
+		fields = fields[1:]
+		// ttl and class are both optional, and we don't care about the ttl:
+		if len(fields) > 0 {
+			if _, err := strconv.ParseUint(fields[0], 10, 32); err == nil {
+				fields = fields[1:]
+			}
+		}
+		if len(fields) > 0 && strings.EqualFold(fields[0], dns.IN.String()) {
+			fields = fields[1:]
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a type and data", lineNum)
+		}
+
+		switch typ, data := strings.ToUpper(fields[0]), fields[1]; typ {
+		case dns.NS.String():
+			if len(owner) != 0 {
+				return nil, fmt.Errorf("line %d: NS record for %s is not for the root", lineNum, owner)
+			}
+			name, err := dns.ParseName(data)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid name %q: %w", lineNum, data, err)
+			}
+			names = append(names, name)
+		case dns.A.String(), dns.AAAA.String():
+			ip := net.ParseIP(data)
+			if ip == nil || (ip.To4() != nil) != (typ == dns.A.String()) {
+				return nil, fmt.Errorf("line %d: invalid %s address %q", lineNum, typ, data)
+			}
+			key := strings.ToLower(owner.String())
+			addrs[key] = append(addrs[key], ip)
+		default:
+			return nil, fmt.Errorf("line %d: unsupported type %s", lineNum, typ)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var servers []NameServer
+	for _, name := range names {
+		if ips := addrs[strings.ToLower(name.String())]; len(ips) > 0 {
+			servers = append(servers, NameServer{Name: name, Addrs: ips})
+		}
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("no root servers with addresses found")
+	}
+	return servers, nil
+}
+
+// primingRetry is how long we wait before trying again after a priming
+// query fails, or while another priming query is in progress.
+const primingRetry = time.Minute
+
+// maxPrimingAttempts limits how many root servers we try in one priming
+// attempt.
+const maxPrimingAttempts = 3
+
+// rootSet is the current set of root servers.
+type rootSet struct {
+	mutex   sync.Mutex
+	servers []NameServer
+	// expires is when the servers should be refreshed with a priming query.
+	// It starts out zero, so that the hints get primed before first use.
+	expires time.Time
+}
+
+func (rs *rootSet) get() []NameServer {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	return rs.servers
+}
+
+func (rs *rootSet) set(servers []NameServer, expires time.Time) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	rs.servers = servers
+	rs.expires = expires
+}
+
+// needsPriming reports whether the caller should send a priming query.
+// Only one caller is told to do so at a time; everyone else carries on with
+// the existing servers.
+func (rs *rootSet) needsPriming(now time.Time) bool {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	if now.Before(rs.expires) {
+		return false
+	}
+	rs.expires = now.Add(primingRetry)
+	return true
+}
+
+// SetRootHints replaces the root servers.  They will be primed before
+// they are next used.
+func (r *Resolver) SetRootHints(servers []NameServer) {
+	r.setup()
+	r.roots.set(slices.Clone(servers), time.Time{})
+}
+
+// LoadRootHints replaces the root servers with those read from a file in
+// named.root format.
+func (r *Resolver) LoadRootHints(in io.Reader) error {
+	servers, err := ParseRootHints(in)
+	if err != nil {
+		return err
+	}
+	r.SetRootHints(servers)
+	return nil
+}
+
+// Roots returns the root servers currently in use.
+func (r *Resolver) Roots() []NameServer {
+	r.setup()
+	return slices.Clone(r.roots.get())
+}
+
+// Prime sends a priming query (RFC 8109) for the NS records of the root
+// zone and replaces the current root servers with those in the response.
+// The root servers are primed again when those records expire.
+func (r *Resolver) Prime(ctx context.Context) error {
+	r.setup()
+	current := r.roots.get()
+	question := dns.Question{Name: dns.Name{}, Type: dns.NS, Class: dns.IN}
+
+	var errs []error
+	for i, ip := range r.addrsOf(current) {
+		if i >= maxPrimingAttempts {
+			break
+		}
+		rsp, err := exchangeTraced(ctx, r.transport(), dns.Name{}, ip, newQuery(question))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		servers, ttl, err := parsePrimingResponse(rsp, current)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", ip, err))
+			continue
+		}
+		r.logger().Info("primed root servers",
+			slog.Int("servers", len(servers)), serverAttr(ip))
+		r.roots.set(servers, time.Now().Add(ttl))
+		return nil
+	}
+	return fmt.Errorf("couldn't prime root servers: %w", errors.Join(errs...))
+}
+
+// primeIfNecessary refreshes the root servers if they have expired.
+// Failures aren't fatal, since we can carry on with the servers we have.
+func (r *Resolver) primeIfNecessary(ctx context.Context) {
+	if !r.roots.needsPriming(time.Now()) {
+		return
+	}
+	if err := r.Prime(ctx); err != nil {
+		r.logger().Warn("couldn't prime root servers, carrying on with the old ones", errAttr(err))
+	}
+}
+
+// parsePrimingResponse extracts the root servers from the response to a
+// priming query, along with how long they are valid for.  Addresses missing
+// from the response are taken from the existing servers, if possible.
+func parsePrimingResponse(rsp dns.Message, current []NameServer) ([]NameServer, time.Duration, error) {
+	if rcode := rsp.Flags.ResponseCode(); rcode != dns.NoError {
+		return nil, 0, fmt.Errorf("priming response has code %s", rcode)
+	}
+
+	var servers []NameServer
+	var ttl time.Duration
+	for _, answer := range rsp.Answers {
+		name, ok := answer.Data.(dns.Name)
+		if !ok || answer.Type != dns.NS || len(answer.Name) != 0 {
+			continue
+		}
+
+		var addrs []net.IP
+		for _, additional := range rsp.Additional {
+			ip, ok := additional.Data.(net.IP)
+			if ok && (additional.Type == dns.A || additional.Type == dns.AAAA) &&
+				additional.Name.Equal(name) {
+				addrs = append(addrs, ip)
+			}
+		}
+		if len(addrs) == 0 {
+			i := slices.IndexFunc(current, func(ns NameServer) bool {
+				return ns.Name.Equal(name)
+			})
+			if i < 0 {
+				continue
+			}
+			addrs = current[i].Addrs
+		}
+
+		servers = append(servers, NameServer{Name: name, Addrs: addrs})
+		if ttl == 0 || answer.TTL < ttl {
+			ttl = answer.TTL
+		}
+	}
+
+	if len(servers) == 0 {
+		return nil, 0, errors.New("no usable root servers in priming response")
+	}
+	return servers, ttl, nil
+}
@@ -0,0 +1,165 @@
+package resolve_test
+
+import (
+	"context"
+	"dns"
+	"dns/resolve"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestBuiltInRootHints(t *testing.T) {
+	roots := resolve.NewResolver().Roots()
+	if len(roots) != 13 {
+		t.Fatalf("expected 13 root servers, got %d", len(roots))
+	}
+	for _, root := range roots {
+		if len(root.Addrs) != 2 {
+			t.Errorf("expected an A and an AAAA address for %s, got %s",
+				root.Name, root.Addrs)
+		}
+	}
+}
+
+func TestParseRootHints(t *testing.T) {
+	roots, err := resolve.ParseRootHints(strings.NewReader(`
+; a comment
+.                  3600000 IN NS  a.root.test.
+.                  3600000    NS  b.root.test. ; trailing comment
+.                             NS  no-address.test.
+a.root.test.       3600000    A     192.0.2.1
+a.root.test.       3600000    AAAA  2001:db8::1
+B.ROOT.TEST.                  a     192.0.2.2
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []resolve.NameServer{
+		{
+			Name:  name("a", "root", "test"),
+			Addrs: []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")},
+		},
+		{
+			Name:  name("b", "root", "test"),
+			Addrs: []net.IP{net.ParseIP("192.0.2.2")},
+		},
+	}
+	if !slices.EqualFunc(expected, roots, equalNameServer) {
+		t.Errorf("expected %s, got %s", expected, roots)
+	}
+}
+
+func TestParseInvalidRootHints(t *testing.T) {
+	for _, test := range []string{
+		"",
+		". NS a.root.test.",
+		"com. NS a.root.test.\na.root.test. A 192.0.2.1",
+		". NS a.root.test.\na.root.test. A 2001:db8::1",
+		". NS a.root.test.\na.root.test. AAAA 192.0.2.1",
+		". NS a.root.test.\na.root.test. MX 10 mx.test.",
+		". NS a..root.test.",
+	} {
+		t.Run(test, func(t *testing.T) {
+			_, err := resolve.ParseRootHints(strings.NewReader(test))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestPrime(t *testing.T) {
+	n := fakeNet{
+		"10.0.0.1": func(q dns.Question) dns.Message {
+			return dns.Message{
+				Answers: []dns.Resource{
+					rr(".", dns.NS, "a.root."),
+					rr(".", dns.NS, "b.root."),
+					rr(".", dns.NS, "c.root."),
+				},
+				Additional: []dns.Resource{
+					rr("b.root.", dns.A, "10.0.0.2"),
+					rr("b.root.", dns.AAAA, "fd00::2"),
+				},
+			}
+		},
+	}
+	r := newTestResolver(n)
+
+	if err := r.Prime(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// a.root keeps its address from the hints, c.root has no address
+	// so it can't be used:
+	expected := []resolve.NameServer{
+		{
+			Name:  name("a", "root"),
+			Addrs: []net.IP{net.ParseIP("10.0.0.1")},
+		},
+		{
+			Name:  name("b", "root"),
+			Addrs: []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("fd00::2")},
+		},
+	}
+	if roots := r.Roots(); !slices.EqualFunc(expected, roots, equalNameServer) {
+		t.Errorf("expected %s, got %s", expected, roots)
+	}
+}
+
+func TestFailedPrimingKeepsHints(t *testing.T) {
+	n := fakeNet{
+		"10.0.0.1": func(q dns.Question) dns.Message {
+			return dns.Message{
+				Flags: dns.Flags(dns.ServerFailure),
+			}
+		},
+	}
+	r := newTestResolver(n)
+
+	if err := r.Prime(context.Background()); err == nil {
+		t.Fatal("expected priming to fail")
+	}
+	if roots := namesOf(r.Roots()); !slices.Equal([]string{"a.root"}, roots) {
+		t.Errorf("expected hints to be kept, got %s", roots)
+	}
+}
+
+func TestResolvePrimesRoots(t *testing.T) {
+	n := testNet()
+	var primed bool
+	root := n["10.0.0.1"]
+	n["10.0.0.1"] = func(q dns.Question) dns.Message {
+		if len(q.Name) == 0 && q.Type == dns.NS {
+			primed = true
+		}
+		return root(q)
+	}
+	r := newTestResolver(n)
+
+	if _, err := r.Resolve(context.Background(), question("www.example.com", dns.A)); err != nil {
+		t.Fatal(err)
+	}
+	if !primed {
+		t.Error("expected a priming query before resolving")
+	}
+
+	primed = false
+	if _, err := r.Resolve(context.Background(), question("example.com", dns.NS)); err != nil {
+		t.Fatal(err)
+	}
+	if primed {
+		t.Error("expected the priming response to still be valid")
+	}
+}
+
+func equalNameServer(a, b resolve.NameServer) bool {
+	return a.Name.Equal(b.Name) && slices.EqualFunc(a.Addrs, b.Addrs, net.IP.Equal)
+}
+
+func name(labels ...dns.Label) dns.Name {
+	return dns.Name(labels)
+}
@@ -0,0 +1,59 @@
+package resolve
+
+import (
+	"dns"
+	"net"
+)
+
+// Routing questions about some zones somewhere other than down from the
+// root, for private zones that the public DNS doesn't know about.
+//
+// A zone can either be forwarded to recursive resolvers that know about it,
+// or be a stub zone, whose authoritative servers we're told about up front
+// instead of finding them through referrals.  Questions about names that
+// aren't in any of the zones are resolved from the root as usual.
+
+// Route sends questions about names in a zone to particular servers.
+type Route struct {
+	Zone dns.Name
+
+	// Forwarder, if it isn't nil, resolves questions about the zone by
+	// asking recursive resolvers.
+	Forwarder *Forwarder
+
+	// Servers are authoritative for the zone, if there's no Forwarder.
+	// Any zones delegated from it are followed as usual, but we never go
+	// above it.
+	Servers []net.IP
+}
+
+// ForwardZone creates a Route that forwards questions about the zone to
+// the upstream resolvers.
+func ForwardZone(zone dns.Name, upstreams ...net.IP) Route {
+	forwarder := NewForwarder(upstreams...)
+	// the resolver caches the answers itself
+	forwarder.Cache = nil
+	return Route{Zone: zone, Forwarder: forwarder}
+}
+
+// StubZone creates a Route that treats the servers as authoritative for the
+// zone.
+func StubZone(zone dns.Name, servers ...net.IP) Route {
+	return Route{Zone: zone, Servers: servers}
+}
+
+// route finds the Route for the most specific zone that name is in, if
+// there is one.
+func (r *Resolver) route(name dns.Name) (Route, bool) {
+	var best Route
+	found := false
+	for _, route := range r.Routes {
+		if !name.Equal(route.Zone) && !name.IsSubdomainOf(route.Zone) {
+			continue
+		}
+		if !found || len(route.Zone) > len(best.Zone) {
+			best, found = route, true
+		}
+	}
+	return best, found
+}
@@ -0,0 +1,137 @@
+package resolve_test
+
+import (
+	"context"
+	"dns"
+	"dns/resolve"
+	"fmt"
+	"net"
+	"slices"
+	"testing"
+)
+
+// routedNet is testNet, plus a recursive resolver at 10.0.9.1 that knows
+// about the private example zone, and an authoritative server for
+// lab.example at 10.0.8.1.
+func routedNet() fakeNet {
+	n := testNet()
+	n["10.0.9.1"] = upstream(
+		rr("www.example.", dns.A, "192.0.2.9"),
+		rr("www.lab.example.", dns.A, "192.0.2.99"),
+	)
+	n["10.0.8.1"] = zone(
+		rr("lab.example.", dns.NS, "ns.lab.example."),
+		rr("ns.lab.example.", dns.A, "10.0.8.1"),
+		rr("www.lab.example.", dns.A, "192.0.2.8"),
+	)
+	return n
+}
+
+func TestRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		answer  string
+		queried string
+	}{
+		{"www.example", "192.0.2.9", "[10.0.9.1]"},
+		// the more specific stub zone wins:
+		{"www.lab.example", "192.0.2.8", "[10.0.8.1]"},
+		// and everything else is resolved from the root, after priming:
+		{"www.example.com", "192.0.2.1", "[10.0.0.1 10.0.0.1 10.0.1.1 10.0.2.1]"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var queried []string
+			n := routedNet().record(&queried)
+			r := newTestResolver(n)
+			forward := resolve.ForwardZone(mustParseName("example."), net.ParseIP("10.0.9.1"))
+			forward.Forwarder.Transport = n
+			r.Routes = []resolve.Route{
+				forward,
+				resolve.StubZone(mustParseName("lab.example."), net.ParseIP("10.0.8.1")),
+			}
+
+			rsp, err := r.Resolve(context.Background(), question(test.name, dns.A))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rsp.Answers) != 1 || !rsp.Answers[0].Data.(net.IP).Equal(net.ParseIP(test.answer)) {
+				t.Errorf("expected %s, got %v", test.answer, rsp.Answers)
+			}
+			if fmt.Sprint(queried) != test.queried {
+				t.Errorf("expected to ask %s, asked %v", test.queried, queried)
+			}
+		})
+	}
+}
+
+func TestForwardedAnswersAreCached(t *testing.T) {
+	var queried []string
+	n := routedNet().record(&queried)
+	r := newTestResolver(n)
+	forward := resolve.ForwardZone(mustParseName("example."), net.ParseIP("10.0.9.1"))
+	forward.Forwarder.Transport = n
+	r.Routes = []resolve.Route{forward}
+
+	for range 2 {
+		if _, err := r.Resolve(context.Background(), question("www.example", dns.A)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fmt.Sprint(queried) != "[10.0.9.1]" {
+		t.Errorf("expected the second answer from the cache, asked %v", queried)
+	}
+}
+
+func TestForwardingTheRootKeepsOtherRoutes(t *testing.T) {
+	var queried []string
+	n := routedNet().record(&queried)
+	r := newTestResolver(n)
+	forward := resolve.ForwardZone(dns.Name{}, net.ParseIP("10.0.9.1"))
+	forward.Forwarder.Transport = n
+	r.Routes = []resolve.Route{
+		forward,
+		resolve.StubZone(mustParseName("lab.example."), net.ParseIP("10.0.8.1")),
+	}
+
+	for _, name := range []string{"www.example", "www.lab.example"} {
+		if _, err := r.Resolve(context.Background(), question(name, dns.A)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// without priming, since the root servers are never used:
+	if fmt.Sprint(queried) != "[10.0.9.1 10.0.8.1]" {
+		t.Errorf("expected to ask [10.0.9.1 10.0.8.1], asked %v", queried)
+	}
+}
+
+func TestForwardedAnswersStayInTheirZone(t *testing.T) {
+	var queried []string
+	n := routedNet()
+	n["10.0.9.1"] = func(q dns.Question) dns.Message {
+		return dns.Message{Answers: []dns.Resource{
+			rr("www.corp.example.", dns.CNAME, "www.example.com."),
+			// only the servers for example.com can tell us this:
+			rr("www.example.com.", dns.A, "6.6.6.6"),
+		}}
+	}
+	recorded := n.record(&queried)
+	r := newTestResolver(recorded)
+	forward := resolve.ForwardZone(mustParseName("corp.example."), net.ParseIP("10.0.9.1"))
+	forward.Forwarder.Transport = recorded
+	r.Routes = []resolve.Route{forward}
+
+	for _, name := range []string{"www.corp.example", "www.example.com"} {
+		rsp, err := r.Resolve(context.Background(), question(name, dns.A))
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := rsp.Answers[len(rsp.Answers)-1]
+		if !a.Data.(net.IP).Equal(net.ParseIP("192.0.2.1")) {
+			t.Errorf("%s: expected the answer from example.com's servers, got %v", name, rsp.Answers)
+		}
+	}
+	if !slices.Contains(queried, "10.0.2.1") {
+		t.Errorf("expected to ask example.com's servers, asked %v", queried)
+	}
+}
@@ -0,0 +1,161 @@
+package resolve
+
+import (
+	"bufio"
+	"dns"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
+// A snapshot of a Cache lets a server restart without forgetting
+// everything, and sending a flood of queries to the authorities to find it
+// all out again.
+//
+// After a header line, each entry is written as:
+//
+//	uint32  length of the rest of the entry
+//	int64   when it was stored, in Unix nanoseconds
+//	int64   when it expires, in Unix nanoseconds
+//	uint8   trust
+//	uint8   1 if it's negative, or 0
+//	...     a DNS message in wire format, with the entry's name, type and
+//	        class as its question, its resources as answers, and its
+//	        response code
+//
+// Times are absolute, so that entries keep expiring while the server is
+// down.
+
+const snapshotHeader = "dns-cache-snapshot 1\n"
+
+var ErrInvalidSnapshot = errors.New("invalid cache snapshot")
+
+var be = binary.BigEndian
+
+// WriteSnapshot writes the entries in the cache to w, including any stale
+// ones that might still be served.
+func (c *Cache) WriteSnapshot(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(snapshotHeader); err != nil {
+		return err
+	}
+
+	var buf []byte
+	for i := range c.allShards() {
+		shard := &c.shards[i]
+		c.lock(shard)
+		entries := make(map[CacheKey]cacheEntry, len(shard.entries))
+		for key, entry := range shard.entries {
+			entries[key] = entry
+		}
+		shard.mutex.Unlock()
+
+		for key, entry := range entries {
+			var err error
+			buf, err = appendSnapshotEntry(buf[:0], key, entry)
+			if err != nil {
+				return fmt.Errorf("%s/%s: %w", entry.name, key.typ, err)
+			}
+			if _, err := bw.Write(buf); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+func appendSnapshotEntry(buf []byte, key CacheKey, entry cacheEntry) ([]byte, error) {
+	msg := dns.Message{
+		Flags: dns.Flags(0).WithType(dns.Response).WithResponseCode(entry.rcode),
+		Questions: []dns.Question{{
+			Name:  entry.name,
+			Type:  key.typ,
+			Class: key.class,
+		}},
+		Answers: entry.resources,
+	}
+
+	// compression offsets are from the start of the message, so it can't
+	// be appended to buf directly:
+	wire, err := msg.WriteTo(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	buf = be.AppendUint32(buf, uint32(18+len(wire)))
+	buf = be.AppendUint64(buf, uint64(entry.stored.UnixNano()))
+	buf = be.AppendUint64(buf, uint64(entry.expires.UnixNano()))
+	buf = append(buf, byte(entry.trust))
+	if entry.negative {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	return append(buf, wire...), nil
+}
+
+// ReadSnapshot adds the entries from a snapshot written by WriteSnapshot
+// to the cache, except for any that have expired since, beyond the
+// StaleWindow.  Entries that are already in the cache are replaced, unless
+// they're trusted more.
+func (c *Cache) ReadSnapshot(r io.Reader) error {
+	br := bufio.NewReader(r)
+	header, err := br.ReadString('\n')
+	if err != nil || header != snapshotHeader {
+		return fmt.Errorf("%w: unknown header %q", ErrInvalidSnapshot, header)
+	}
+
+	c.setup()
+	now := c.Now()
+	var lengthBuf [4]byte
+	var buf []byte
+	for {
+		if _, err := io.ReadFull(br, lengthBuf[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+		}
+		length := be.Uint32(lengthBuf[:])
+		if length < 18 || length > 18+65535 {
+			return fmt.Errorf("%w: entry length %d", ErrInvalidSnapshot, length)
+		}
+		buf = slices.Grow(buf[:0], int(length))[:length]
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+		}
+
+		key, entry, err := parseSnapshotEntry(buf)
+		if err != nil {
+			return err
+		}
+		if !now.Before(entry.expires.Add(c.StaleWindow)) {
+			continue
+		}
+		c.store(key, entry, now)
+	}
+}
+
+func parseSnapshotEntry(buf []byte) (CacheKey, cacheEntry, error) {
+	entry := cacheEntry{
+		stored:   time.Unix(0, int64(be.Uint64(buf[0:]))),
+		expires:  time.Unix(0, int64(be.Uint64(buf[8:]))),
+		trust:    Trust(buf[16]),
+		negative: buf[17] == 1,
+	}
+	msg, err := dns.ParseMessage(buf[18:])
+	if err != nil {
+		return CacheKey{}, cacheEntry{}, fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+	}
+	if len(msg.Questions) != 1 || len(msg.Answers) == 0 {
+		return CacheKey{}, cacheEntry{}, fmt.Errorf("%w: malformed entry", ErrInvalidSnapshot)
+	}
+
+	question := msg.Questions[0]
+	entry.name = question.Name
+	entry.resources = msg.Answers
+	entry.rcode = msg.Flags.ResponseCode()
+	return newCacheKey(question), entry, nil
+}
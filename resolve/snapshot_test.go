@@ -0,0 +1,95 @@
+package resolve_test
+
+import (
+	"bytes"
+	"dns"
+	"dns/resolve"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	c, clock := newTestCache()
+	c.Put([]dns.Resource{
+		rr("www.foo.bar.", dns.CNAME, "web.foo.bar."),
+		rr("web.foo.bar.", dns.A, "192.0.2.1"),
+		rr("web.foo.bar.", dns.AAAA, "2001:db8::1"),
+	}, resolve.TrustAnswer)
+	c.Put([]dns.Resource{rr("foo.bar.", dns.NS, "ns.foo.bar.")}, resolve.TrustGlue)
+	c.PutNegative(question("nope.foo.bar", dns.A), dns.NameError, soa("foo.bar.", time.Hour, time.Hour))
+	c.PutNegative(question("web.foo.bar", dns.MX), dns.NoError, soa("foo.bar.", time.Hour, time.Hour))
+
+	var snapshot bytes.Buffer
+	if err := c.WriteSnapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	// the time keeps passing while we're down:
+	clock.Advance(10 * time.Minute)
+	restored, _ := newTestCache()
+	restored.Now = clock.Now
+	if err := restored.ReadSnapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	var original, got strings.Builder
+	if err := c.Dump(&original); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Dump(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != original.String() {
+		t.Errorf("expected:\n%s\ngot:\n%s", original.String(), got.String())
+	}
+	if !strings.Contains(got.String(), "ttl=50m0s") {
+		t.Errorf("expected TTLs to have gone down while the cache was saved, got:\n%s", got.String())
+	}
+}
+
+func TestSnapshotDiscardsExpiredEntries(t *testing.T) {
+	c, clock := newTestCache()
+	c.Put([]dns.Resource{rr("short.foo.bar.", dns.A, "192.0.2.1")}, resolve.TrustAnswer)
+	long := rr("long.foo.bar.", dns.A, "192.0.2.2")
+	long.TTL = 2 * time.Hour
+	c.Put([]dns.Resource{long}, resolve.TrustAnswer)
+
+	var snapshot bytes.Buffer
+	if err := c.WriteSnapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Hour)
+	restored, _ := newTestCache()
+	restored.Now = clock.Now
+	if err := restored.ReadSnapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range restored.Entries() {
+		names = append(names, entry.Name.String())
+	}
+	if fmt.Sprint(names) != "[long.foo.bar]" {
+		t.Errorf("expected only long.foo.bar to be restored, got %v", names)
+	}
+	if size := restored.Stats().Size; size != 1 {
+		t.Errorf("expected 1 entry in the cache, got %d", size)
+	}
+}
+
+func TestInvalidSnapshot(t *testing.T) {
+	for _, snapshot := range []string{
+		"",
+		"not a snapshot\n",
+		"dns-cache-snapshot 1\n\x00\x00",
+		"dns-cache-snapshot 1\n\x00\x00\x00\x20" + strings.Repeat("\x00", 0x20),
+	} {
+		c := resolve.NewCache()
+		if err := c.ReadSnapshot(strings.NewReader(snapshot)); !errors.Is(err, resolve.ErrInvalidSnapshot) {
+			t.Errorf("%q: expected an invalid snapshot error, got %v", snapshot, err)
+		}
+	}
+}
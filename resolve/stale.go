@@ -0,0 +1,245 @@
+package resolve
+
+import (
+	"context"
+	"dns"
+	"sync"
+	"time"
+)
+
+// Serving stale answers, from RFC 8767.
+//
+// When the authorities for a name can't be reached, it's better to give
+// clients the answers that we had before than nothing at all.  The Cache
+// keeps entries for a while after they expire, and if resolution fails we
+// answer from those instead, with a short TTL and an extended DNS error
+// saying what we've done.
+//
+// Having failed once, we don't try again for every query, since that would
+// make every client wait for the same timeout.  Instead we keep serving the
+// stale answer, and keep trying to refresh it in the background.
+//
+// The first query after the authorities go quiet would still wait for the
+// whole resolution to time out, which is longer than stub resolvers wait.
+// So if there's a stale answer, we only wait for a fresh one for the
+// "client response timer", and answer from the stale one after that while
+// the resolution carries on.
+
+// defaultStaleRefreshInterval is the "failure recheck timer" from RFC 8767.
+const defaultStaleRefreshInterval = 30 * time.Second
+
+// defaultStaleAnswerTimeout is the "client response timer" from RFC 8767.
+const defaultStaleAnswerTimeout = 1800 * time.Millisecond
+
+// staleUDPSize is the UDP payload size that we advertise in the OPT
+// resource of stale answers.
+const staleUDPSize = 1232
+
+// refreshState keeps track of the questions that are being refreshed in
+// the background, and the ones that we're serving stale answers for.
+type refreshState struct {
+	mutex      sync.Mutex
+	failed     map[CacheKey]time.Time
+	refreshing map[CacheKey]bool
+}
+
+func newRefreshState() *refreshState {
+	return &refreshState{
+		failed:     make(map[CacheKey]time.Time),
+		refreshing: make(map[CacheKey]bool),
+	}
+}
+
+// recentlyFailed checks whether resolving the question failed within the
+// refresh interval.
+func (s *refreshState) recentlyFailed(key CacheKey, interval time.Duration) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	failed, ok := s.failed[key]
+	return ok && time.Since(failed) < interval
+}
+
+func (s *refreshState) fail(key CacheKey) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failed[key] = time.Now()
+}
+
+func (s *refreshState) forget(key CacheKey) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.failed, key)
+}
+
+// startRefreshing checks that nothing else is refreshing the question, and
+// claims it if so.
+func (s *refreshState) startRefreshing(key CacheKey) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.refreshing[key] {
+		return false
+	}
+	s.refreshing[key] = true
+	return true
+}
+
+func (s *refreshState) stopRefreshing(key CacheKey) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.refreshing, key)
+}
+
+func (r *Resolver) staleRefreshInterval() time.Duration {
+	if r.StaleRefreshInterval > 0 {
+		return r.StaleRefreshInterval
+	}
+	return defaultStaleRefreshInterval
+}
+
+func (r *Resolver) staleAnswerTimeout() time.Duration {
+	if r.StaleAnswerTimeout > 0 {
+		return r.StaleAnswerTimeout
+	}
+	return defaultStaleAnswerTimeout
+}
+
+// resolveOrStale resolves the question like resolveShared, unless that
+// takes longer than the StaleAnswerTimeout and we have a stale answer, in
+// which case it answers with that and leaves the resolution to carry on
+// in the background.  If that fails, the stale answer is refreshed like
+// any other.
+func (r *Resolver) resolveOrStale(ctx context.Context, question dns.Question, key CacheKey) (dns.Message, error) {
+	if !r.hasStale(question) {
+		return r.resolveShared(ctx, question)
+	}
+
+	type result struct {
+		msg dns.Message
+		err error
+	}
+	done := make(chan result, 1)
+	detached, stop := detach(ctx)
+	defer stop()
+	go func() {
+		msg, err := r.resolveShared(detached, question)
+		done <- result{msg, err}
+	}()
+
+	timer := time.NewTimer(r.staleAnswerTimeout())
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res.msg, res.err
+	case <-ctx.Done():
+		return dns.Message{}, context.Cause(ctx)
+	case <-timer.C:
+	}
+
+	msg, ok := r.staleAnswer(question)
+	if !ok {
+		// it's expired since we looked
+		select {
+		case res := <-done:
+			return res.msg, res.err
+		case <-ctx.Done():
+			return dns.Message{}, context.Cause(ctx)
+		}
+	}
+	r.logger().Info("slow to resolve, serving stale answer",
+		qnameAttr(question.Name), qtypeAttr(question.Type),
+		rcodeAttr(msg.Flags.ResponseCode()), cacheAttr("stale"))
+	traceEvent(ctx, TraceEvent{Kind: TraceStale, Question: question})
+	go func() {
+		if res := <-done; res.err != nil {
+			r.refreshes.fail(key)
+			r.refreshInBackground(question, key)
+		}
+	}()
+	return msg, nil
+}
+
+// hasStale checks whether there's a stale answer to the question, without
+// using it.
+func (r *Resolver) hasStale(question dns.Question) bool {
+	if r.Cache.StaleWindow <= 0 {
+		return false
+	}
+	if _, _, ok := r.Cache.answer(question, readStale|readPeek); ok {
+		return true
+	}
+	_, _, ok := r.Cache.negative(question, readStale|readPeek)
+	return ok
+}
+
+// serveStale answers the question from stale cache entries, if there are
+// any, and starts refreshing them in the background.
+func (r *Resolver) serveStale(question dns.Question) (dns.Message, bool) {
+	msg, ok := r.staleAnswer(question)
+	if !ok {
+		return dns.Message{}, false
+	}
+	r.logger().Info("serving stale answer",
+		qnameAttr(question.Name), qtypeAttr(question.Type),
+		rcodeAttr(msg.Flags.ResponseCode()), cacheAttr("stale"))
+	r.refreshInBackground(question, newCacheKey(question))
+	return msg, true
+}
+
+// refreshInBackground starts refreshing the stale answer to the question,
+// unless that's already happening.
+func (r *Resolver) refreshInBackground(question dns.Question, key CacheKey) {
+	if r.refreshes.startRefreshing(key) {
+		go r.refreshStale(question, key)
+	}
+}
+
+// staleAnswer makes an answer to the question from stale cache entries,
+// which might say that it has no answers.
+func (r *Resolver) staleAnswer(question dns.Question) (dns.Message, bool) {
+	if answers, ok := r.Cache.GetStale(question); ok {
+		return dns.Message{
+			Flags:   dns.Flags(0).WithType(dns.Response),
+			Answers: answers,
+			Additional: []dns.Resource{
+				dns.NewOPT(staleUDPSize, dns.NewExtendedError(dns.StaleAnswer, "")),
+			},
+		}, true
+	}
+
+	rcode, soa, ok := r.Cache.GetStaleNegative(question)
+	if !ok {
+		return dns.Message{}, false
+	}
+	code := dns.StaleAnswer
+	if rcode == dns.NameError {
+		code = dns.StaleNXDomainAnswer
+	}
+	soa.TTL = r.Cache.staleTTL()
+	return dns.Message{
+		Flags:       dns.Flags(0).WithType(dns.Response).WithResponseCode(rcode),
+		Authorities: []dns.Resource{soa},
+		Additional: []dns.Resource{
+			dns.NewOPT(staleUDPSize, dns.NewExtendedError(code, "")),
+		},
+	}, true
+}
+
+// refreshStale keeps trying to resolve the question, until it works or the
+// stale answers for it run out.
+func (r *Resolver) refreshStale(question dns.Question, key CacheKey) {
+	defer r.refreshes.stopRefreshing(key)
+	defer r.refreshes.forget(key)
+	for {
+		time.Sleep(r.staleRefreshInterval())
+		_, err := r.resolveShared(context.Background(), question)
+		if err == nil {
+			r.logger().Info("refreshed stale answer",
+				qnameAttr(question.Name), qtypeAttr(question.Type))
+			return
+		}
+		if !r.hasStale(question) {
+			return
+		}
+		r.refreshes.fail(key)
+	}
+}
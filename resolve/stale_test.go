@@ -0,0 +1,187 @@
+package resolve_test
+
+import (
+	"context"
+	"dns"
+	"dns/resolve"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyNet is a fakeNet that can be cut off from the resolver.
+type flakyNet struct {
+	fakeNet
+	down atomic.Bool
+}
+
+func (n *flakyNet) Exchange(ctx context.Context, server net.IP, query dns.Message) (dns.Message, error) {
+	if n.down.Load() {
+		return dns.Message{}, errors.New("network is unreachable")
+	}
+	return n.fakeNet.Exchange(ctx, server, query)
+}
+
+func TestServeStaleWhenAuthoritiesFail(t *testing.T) {
+	n := &flakyNet{fakeNet: testNet()}
+	r := newTestResolver(n)
+	r.StaleRefreshInterval = 10 * time.Millisecond
+	c, clock := newTestCache()
+	c.StaleWindow = time.Hour
+	r.Cache = c
+	q := question("www.example.com", dns.A)
+
+	if _, err := r.Resolve(context.Background(), q); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Hour + time.Second)
+	n.down.Store(true)
+	rsp, err := r.Resolve(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rsp.Answers) != 1 || rsp.Answers[0].TTL != 30*time.Second {
+		t.Errorf("expected a stale answer with a TTL of 30s, got %v", rsp.Answers)
+	}
+	if !hasExtendedError(t, rsp, dns.StaleAnswer) {
+		t.Errorf("expected a stale answer error, got %v", rsp.Additional)
+	}
+
+	// it's refreshed in the background once the servers are back:
+	n.down.Store(false)
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := c.Get(q); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the stale answer to be refreshed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServeStaleWhenAuthoritiesAreSlow(t *testing.T) {
+	n := testNet()
+	r := newTestResolver(n)
+	r.StaleAnswerTimeout = 10 * time.Millisecond
+	r.Budget = resolve.Budget{MaxTime: time.Second}
+	c, clock := newTestCache()
+	c.StaleWindow = time.Hour
+	r.Cache = c
+	q := question("www.example.com", dns.A)
+
+	if _, err := r.Resolve(context.Background(), q); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Hour + time.Second)
+	n["10.0.2.1"] = nil // never answers
+	start := time.Now()
+	rsp, err := r.Resolve(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("expected a stale answer before resolution timed out, took %s", elapsed)
+	}
+	if len(rsp.Answers) != 1 || !hasExtendedError(t, rsp, dns.StaleAnswer) {
+		t.Errorf("expected a stale answer, got %v %v", rsp.Answers, rsp.Additional)
+	}
+}
+
+func TestServeStaleNXDomain(t *testing.T) {
+	n := &flakyNet{fakeNet: testNet()}
+	r := newTestResolver(n)
+	c, clock := newTestCache()
+	c.StaleWindow = time.Hour
+	r.Cache = c
+	q := question("nope.example.com", dns.A)
+	c.PutNegative(q, dns.NameError, dns.Resource{
+		Name:  mustParseName("example.com."),
+		Type:  dns.SOA,
+		Class: dns.IN,
+		TTL:   time.Hour,
+		Data:  dns.SOARecord{MinTTL: time.Minute},
+	})
+
+	clock.Advance(2 * time.Minute)
+	n.down.Store(true)
+	rsp, err := r.Resolve(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rcode := rsp.Flags.ResponseCode(); rcode != dns.NameError {
+		t.Errorf("expected a stale NXDOMAIN, got %s", rcode)
+	}
+	if !hasExtendedError(t, rsp, dns.StaleNXDomainAnswer) {
+		t.Errorf("expected a stale NXDOMAIN error, got %v", rsp.Additional)
+	}
+}
+
+func TestNoStaleAnswerWithoutStaleWindow(t *testing.T) {
+	n := &flakyNet{fakeNet: testNet()}
+	r := newTestResolver(n)
+	c, clock := newTestCache()
+	r.Cache = c
+	q := question("www.example.com", dns.A)
+
+	if _, err := r.Resolve(context.Background(), q); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Hour + time.Second)
+	n.down.Store(true)
+	if rsp, err := r.Resolve(context.Background(), q); err == nil {
+		t.Errorf("expected resolution to fail, got %v", rsp.Answers)
+	}
+}
+
+func hasExtendedError(t *testing.T, rsp dns.Message, expected dns.ExtendedErrorCode) bool {
+	t.Helper()
+	opt, ok := rsp.FindOPT()
+	if !ok {
+		return false
+	}
+	options, err := dns.EDNSOptions(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, option := range options {
+		if code, _, err := dns.ParseExtendedError(option); err == nil && code == expected {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRefreshingStaleAnswersDoesNotUseThem(t *testing.T) {
+	n := &flakyNet{fakeNet: testNet()}
+	n.down.Store(true)
+	r := newTestResolver(n)
+	r.StaleRefreshInterval = time.Millisecond
+	c, clock := newTestCache()
+	c.StaleWindow = time.Hour
+	c.MaxEntries = 2
+	r.Cache = c
+	putA(c, "www.example.com")
+	clock.Advance(time.Hour + time.Second)
+	c.Put([]dns.Resource{rr("other.test.", dns.A, "192.0.2.2")}, resolve.TrustAnswer)
+
+	if _, err := r.Resolve(context.Background(), question("www.example.com", dns.A)); err != nil {
+		t.Fatal(err)
+	}
+	// other.test. is used after the stale answer was served, and checking
+	// that the stale answer is still there while refreshing it mustn't
+	// count as using it again:
+	cached(c, "other.test")
+	time.Sleep(50 * time.Millisecond)
+	putA(c, "new.test")
+
+	if got := cached(c, "other.test", "new.test"); len(got) != 2 {
+		t.Errorf("expected the stale answer to be evicted, got %v", got)
+	}
+}
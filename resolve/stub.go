@@ -0,0 +1,251 @@
+package resolve
+
+import (
+	"bufio"
+	"context"
+	"dns"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A stub resolver, which asks the recursive resolvers in resolv.conf to do
+// all of the work, as the C library does.
+
+// ResolvConf is the configuration of a stub resolver, from resolv.conf(5).
+type ResolvConf struct {
+	// Nameservers are the recursive resolvers to ask, in order.  Defaults
+	// to the local host.
+	Nameservers []net.IP
+
+	// Search is the list of domains that relative names are looked up in.
+	Search []dns.Name
+
+	// Ndots is how many dots a name needs before it's looked up as it
+	// is, before trying the search list.  Defaults to 1.
+	Ndots int
+
+	// Timeout is how long to wait for each nameserver.  Defaults to 5s.
+	Timeout time.Duration
+
+	// Attempts is how many times to go through the nameservers before
+	// giving up.  Defaults to 2.
+	Attempts int
+
+	// Rotate spreads the queries between the nameservers, instead of
+	// always asking the first one first.
+	Rotate bool
+}
+
+// these are the limits from resolv.conf(5)
+const (
+	maxNdots    = 15
+	maxTimeout  = 30 * time.Second
+	maxAttempts = 5
+)
+
+// DefaultResolvConf is the configuration when resolv.conf is empty.
+var DefaultResolvConf = ResolvConf{
+	Nameservers: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	Ndots:       1,
+	Timeout:     5 * time.Second,
+	Attempts:    2,
+}
+
+// ParseResolvConf parses a file in resolv.conf format.  Like the C
+// library, it ignores anything that it doesn't understand, including
+// nameservers with addresses that it can't parse.
+func ParseResolvConf(r io.Reader) (ResolvConf, error) {
+	conf := DefaultResolvConf
+	conf.Nameservers = nil
+
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "nameserver":
+			if len(fields) < 2 {
+				continue
+			}
+			if ip := net.ParseIP(fields[1]); ip != nil {
+				conf.Nameservers = append(conf.Nameservers, ip)
+			}
+		case "domain", "search":
+			// whichever comes last wins
+			conf.Search = nil
+			for _, field := range fields[1:] {
+				domain, err := dns.ParseName(field)
+				if err != nil {
+					return ResolvConf{}, fmt.Errorf("line %d: invalid domain %q: %w", lineNum, field, err)
+				}
+				conf.Search = append(conf.Search, domain)
+			}
+		case "options":
+			for _, option := range fields[1:] {
+				conf.parseOption(option)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return ResolvConf{}, err
+	}
+
+	if len(conf.Nameservers) == 0 {
+		conf.Nameservers = DefaultResolvConf.Nameservers
+	}
+	return conf, nil
+}
+
+func (conf *ResolvConf) parseOption(option string) {
+	name, value, _ := strings.Cut(option, ":")
+	n, err := strconv.Atoi(value)
+	switch {
+	case name == "rotate":
+		conf.Rotate = true
+	case err != nil:
+		return
+	case name == "ndots":
+		conf.Ndots = min(max(n, 0), maxNdots)
+	case name == "timeout":
+		conf.Timeout = min(max(time.Duration(n)*time.Second, time.Second), maxTimeout)
+	case name == "attempts":
+		conf.Attempts = min(max(n, 1), maxAttempts)
+	}
+}
+
+// LoadResolvConf reads the configuration from a file, usually
+// /etc/resolv.conf.
+func LoadResolvConf(path string) (ResolvConf, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return ResolvConf{}, err
+	}
+	defer f.Close()
+	return ParseResolvConf(f)
+}
+
+// candidates are the names to look up for a name that we've been given, in
+// order.  Names ending in a dot are absolute, and only looked up as they
+// are.  Otherwise, names with at least Ndots dots are tried as they are
+// before the search list, and the rest after it.
+func (conf ResolvConf) candidates(s string) ([]dns.Name, error) {
+	name, err := dns.ParseName(s)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(s, ".") || len(name) == 0 {
+		return []dns.Name{name}, nil
+	}
+
+	var candidates []dns.Name
+	asIs := len(name)-1 >= conf.Ndots
+	if asIs {
+		candidates = append(candidates, name)
+	}
+	for _, domain := range conf.Search {
+		candidate := append(slices.Clone(name), domain...)
+		if wireLength(candidate) <= 255 {
+			candidates = append(candidates, candidate)
+		}
+	}
+	if !asIs {
+		candidates = append(candidates, name)
+	}
+	return candidates, nil
+}
+
+// StubResolver looks names up by asking recursive resolvers.
+type StubResolver struct {
+	conf      ResolvConf
+	forwarder *Forwarder
+}
+
+// NewStubResolver creates a StubResolver that asks the nameservers in the
+// configuration over UDP, or TCP if the responses are too big.
+func NewStubResolver(conf ResolvConf) *StubResolver {
+	forwarder := NewForwarder(conf.Nameservers...)
+	forwarder.Transport = UDPTransport{Timeout: conf.Timeout}
+	forwarder.TCPTransport = TCPTransport{Timeout: conf.Timeout}
+	forwarder.Cache = nil
+	if conf.Rotate {
+		forwarder.Strategy = Random
+	}
+	return &StubResolver{conf: conf, forwarder: forwarder}
+}
+
+// SetTransport replaces the transports that are used to reach the
+// nameservers.
+func (s *StubResolver) SetTransport(transport Transport) {
+	s.forwarder.Transport = transport
+	s.forwarder.TCPTransport = transport
+}
+
+// Lookup looks up records of the given type for a name, which may be
+// relative to the domains in the search list.  The first response with
+// answers is returned, or if there isn't one, the last response for a
+// name in the search.  As with glibc, a name that fails, perhaps because
+// its servers are down, doesn't stop the search, and it's only an error
+// if every name fails.
+func (s *StubResolver) Lookup(ctx context.Context, name string, typ dns.QueryType) (dns.Message, error) {
+	candidates, err := s.conf.candidates(name)
+	if err != nil {
+		return dns.Message{}, err
+	}
+
+	var last dns.Message
+	var responded bool
+	var errs []error
+	for _, candidate := range candidates {
+		rsp, err := s.exchange(ctx, dns.Question{
+			Name:  candidate,
+			Type:  typ,
+			Class: dns.IN,
+		})
+		if ctx.Err() != nil {
+			return dns.Message{}, context.Cause(ctx)
+		} else if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if len(rsp.Answers) > 0 {
+			return rsp, nil
+		}
+		last, responded = rsp, true
+	}
+	if !responded {
+		return dns.Message{}, errors.Join(errs...)
+	}
+	return last, nil
+}
+
+// exchange asks the nameservers the question, going through them as many
+// times as we're allowed to.
+func (s *StubResolver) exchange(ctx context.Context, question dns.Question) (dns.Message, error) {
+	attempts := max(s.conf.Attempts, 1)
+	var errs []error
+	for range attempts {
+		rsp, err := s.forwarder.Resolve(ctx, question)
+		if err == nil {
+			return rsp, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return dns.Message{}, errors.Join(errs...)
+}
@@ -0,0 +1,151 @@
+package resolve_test
+
+import (
+	"context"
+	"dns"
+	"dns/resolve"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseResolvConf(t *testing.T) {
+	conf, err := resolve.ParseResolvConf(strings.NewReader(`
+# generated by something
+nameserver 10.0.9.1
+nameserver fe80::1%eth0 ; we can't use this one
+nameserver 2001:db8::1
+domain ignored.example
+search corp.example example.com
+options ndots:2 timeout:1 attempts:9 rotate unknown
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := resolve.ResolvConf{
+		Nameservers: []net.IP{net.ParseIP("10.0.9.1"), net.ParseIP("2001:db8::1")},
+		Search:      []dns.Name{mustParseName("corp.example"), mustParseName("example.com")},
+		Ndots:       2,
+		Timeout:     time.Second,
+		Attempts:    5,
+		Rotate:      true,
+	}
+	if !reflect.DeepEqual(conf, want) {
+		t.Errorf("expected %+v, got %+v", want, conf)
+	}
+}
+
+func TestParseEmptyResolvConf(t *testing.T) {
+	conf, err := resolve.ParseResolvConf(strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(conf, resolve.DefaultResolvConf) {
+		t.Errorf("expected the defaults, got %+v", conf)
+	}
+}
+
+func TestStubSearchList(t *testing.T) {
+	tests := []struct {
+		name    string
+		asked   string
+		answers int
+	}{
+		// fewer than ndots dots, so the search list comes first:
+		{"www", "[www.corp.example www.example.com]", 1},
+		// enough dots to try it as it is first:
+		{"www.example.com", "[www.example.com]", 1},
+		{"mail.example.com", "[mail.example.com mail.example.com.corp.example mail.example.com.example.com]", 0},
+		// absolute names are only tried as they are:
+		{"www.", "[www]", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mutex sync.Mutex
+			var asked []string
+			www := upstream(rr("www.example.com.", dns.A, "192.0.2.1"))
+			s := resolve.NewStubResolver(resolve.ResolvConf{
+				Nameservers: []net.IP{net.ParseIP("10.0.9.1")},
+				Search:      []dns.Name{mustParseName("corp.example"), mustParseName("example.com")},
+				Ndots:       1,
+			})
+			s.SetTransport(fakeNet{"10.0.9.1": func(q dns.Question) dns.Message {
+				mutex.Lock()
+				asked = append(asked, q.Name.String())
+				mutex.Unlock()
+				rsp := www(q)
+				if len(rsp.Answers) == 0 {
+					rsp.Flags = rsp.Flags.WithResponseCode(dns.NameError)
+				}
+				return rsp
+			}})
+
+			rsp, err := s.Lookup(context.Background(), test.name, dns.A)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rsp.Answers) != test.answers {
+				t.Errorf("expected %d answers, got %v", test.answers, rsp.Answers)
+			}
+			if fmt.Sprint(asked) != test.asked {
+				t.Errorf("expected to ask for %s, asked for %v", test.asked, asked)
+			}
+		})
+	}
+}
+
+func TestStubRetriesAttempts(t *testing.T) {
+	var queried []string
+	n := fakeNet{"10.0.9.1": servfail, "10.0.9.2": servfail}
+	s := resolve.NewStubResolver(resolve.ResolvConf{
+		Nameservers: []net.IP{net.ParseIP("10.0.9.1"), net.ParseIP("10.0.9.2")},
+		Attempts:    2,
+	})
+	s.SetTransport(n.record(&queried))
+
+	if _, err := s.Lookup(context.Background(), "www.example.com.", dns.A); err == nil {
+		t.Error("expected an error")
+	}
+	if fmt.Sprint(queried) != "[10.0.9.1 10.0.9.2 10.0.9.1 10.0.9.2]" {
+		t.Errorf("expected to go through the nameservers twice, asked %v", queried)
+	}
+}
+
+func TestStubSearchListSkipsFailures(t *testing.T) {
+	www := upstream(rr("www.example.com.", dns.A, "192.0.2.1"))
+	s := resolve.NewStubResolver(resolve.ResolvConf{
+		Nameservers: []net.IP{net.ParseIP("10.0.9.1")},
+		Search:      []dns.Name{mustParseName("corp.example"), mustParseName("example.com")},
+		Ndots:       1,
+		Attempts:    1,
+	})
+	s.SetTransport(fakeNet{"10.0.9.1": func(q dns.Question) dns.Message {
+		// corp.example's servers are down:
+		if strings.HasSuffix(q.Name.String(), "corp.example") {
+			return servfail(q)
+		}
+		return www(q)
+	}})
+
+	rsp, err := s.Lookup(context.Background(), "www", dns.A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rsp.Answers) != 1 {
+		t.Errorf("expected the answer for www.example.com, got %v", rsp.Answers)
+	}
+
+	if _, err := s.Lookup(context.Background(), "mail", dns.A); err != nil {
+		t.Errorf("expected mail.example.com's response, got %v", err)
+	}
+
+	s.SetTransport(fakeNet{"10.0.9.1": servfail})
+	if _, err := s.Lookup(context.Background(), "www", dns.A); err == nil {
+		t.Error("expected an error when every name fails")
+	}
+}
@@ -0,0 +1,195 @@
+package resolve
+
+import (
+	"context"
+	"dns"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Tracing the steps that a resolution takes, for debugging.
+//
+// The function that receives the steps travels in the context, so that it
+// reaches everything that's done on behalf of a resolution, including
+// looking up name servers.  It doesn't reach the background refreshes that
+// a resolution starts, or an identical resolution that it waits for
+// instead of doing the work itself, although that's traced as a step.
+// Nor does it reach work that carries on after the resolution has
+// returned, such as when a stale answer is served instead of waiting.
+
+// TraceKind says what kind of step a TraceEvent is.
+type TraceKind int
+
+const (
+	// TraceQuery is a query sent to a server, and its response.
+	TraceQuery TraceKind = iota
+	// TraceReferral is a referral that we followed to Target.
+	TraceReferral
+	// TraceNSLookup is the start of looking up the addresses of Target,
+	// a server for Zone that we were referred to without any.
+	TraceNSLookup
+	// TraceChain is a CNAME or DNAME that we followed to Target.
+	TraceChain
+	// TraceCacheHit is an answer from the cache, or a negative answer
+	// if RCode says so.
+	TraceCacheHit
+	// TraceStale is a stale answer from the cache.
+	TraceStale
+	// TraceForward is a question handed to the forwarders for Zone.
+	TraceForward
+	// TraceShared is a wait for an identical resolution that was
+	// already in flight.
+	TraceShared
+)
+
+func (k TraceKind) String() string {
+	switch k {
+	case TraceQuery:
+		return "Query"
+	case TraceReferral:
+		return "Referral"
+	case TraceNSLookup:
+		return "NSLookup"
+	case TraceChain:
+		return "Chain"
+	case TraceCacheHit:
+		return "CacheHit"
+	case TraceStale:
+		return "Stale"
+	case TraceForward:
+		return "Forward"
+	case TraceShared:
+		return "Shared"
+	default:
+		return fmt.Sprintf("TraceKind(%d)", int(k))
+	}
+}
+
+// TraceEvent is a step in a resolution.  Which fields are set depends on
+// its kind.
+type TraceEvent struct {
+	Kind     TraceKind
+	Question dns.Question
+
+	// Zone is the zone whose servers were queried, or that a referral or
+	// name server lookup was for.
+	Zone dns.Name
+	// Server is the server that a query was sent to.
+	Server net.IP
+	// RTT is how long a query took.
+	RTT time.Duration
+	// RCode is the response code of a query, or of a cached answer.
+	RCode dns.ResponseCode
+	// Err is why a query failed.
+	Err error
+	// Target is where a referral or chain led, or the name server that
+	// was looked up.
+	Target dns.Name
+}
+
+func (e TraceEvent) String() string {
+	q := fmt.Sprintf("%s/%s", zoneString(e.Question.Name), e.Question.Type)
+	switch e.Kind {
+	case TraceQuery:
+		if e.Err != nil {
+			return fmt.Sprintf("%s @%s -> %s after %s", q, e.Server, e.Err, e.RTT.Round(time.Millisecond))
+		}
+		return fmt.Sprintf("%s @%s -> %s in %s", q, e.Server, e.RCode, e.RTT.Round(time.Millisecond))
+	case TraceReferral:
+		return fmt.Sprintf("%s: referred to %s", q, zoneString(e.Target))
+	case TraceNSLookup:
+		return fmt.Sprintf("%s: looking up %s, a server for %s", q, e.Target, zoneString(e.Zone))
+	case TraceChain:
+		return fmt.Sprintf("%s: following chain to %s", q, e.Target)
+	case TraceCacheHit:
+		return fmt.Sprintf("%s: %s from cache", q, e.RCode)
+	case TraceStale:
+		return fmt.Sprintf("%s: stale answer from cache", q)
+	case TraceForward:
+		return fmt.Sprintf("%s: forwarding to the servers for %s", q, zoneString(e.Zone))
+	case TraceShared:
+		return fmt.Sprintf("%s: waiting for the same question in flight", q)
+	default:
+		return fmt.Sprintf("%s: %s", q, e.Kind)
+	}
+}
+
+type traceKey struct{}
+
+// WithTrace returns a context that makes resolutions call trace for each
+// step that they take.  It may be called from several goroutines at once.
+func WithTrace(ctx context.Context, trace func(TraceEvent)) context.Context {
+	return context.WithValue(ctx, traceKey{}, trace)
+}
+
+func traceEvent(ctx context.Context, event TraceEvent) {
+	if trace, ok := ctx.Value(traceKey{}).(func(TraceEvent)); ok {
+		trace(event)
+	}
+}
+
+// detach returns a context for work that might carry on after the caller
+// has returned, which isn't cancelled along with ctx.  Its steps are only
+// traced until stop is called, when the caller returns.
+func detach(ctx context.Context) (detached context.Context, stop func()) {
+	detached = context.WithoutCancel(ctx)
+	trace, ok := ctx.Value(traceKey{}).(func(TraceEvent))
+	if !ok {
+		return detached, func() {}
+	}
+
+	var mutex sync.Mutex
+	stopped := false
+	detached = WithTrace(detached, func(event TraceEvent) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !stopped {
+			trace(event)
+		}
+	})
+	return detached, func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		stopped = true
+	}
+}
+
+// ResolveTrace resolves the question like Resolve, and also returns the
+// steps that it took.
+func (r *Resolver) ResolveTrace(ctx context.Context, question dns.Question) (dns.Message, []TraceEvent, error) {
+	var mutex sync.Mutex
+	var events []TraceEvent
+	ctx = WithTrace(ctx, func(event TraceEvent) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		events = append(events, event)
+	})
+
+	msg, err := r.Resolve(ctx, question)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	return msg, slices.Clone(events), err
+}
+
+// exchangeTraced sends a query with transport, and traces it.
+func exchangeTraced(ctx context.Context, transport Transport, zone dns.Name, server net.IP, query dns.Message) (dns.Message, error) {
+	start := time.Now()
+	rsp, err := transport.Exchange(ctx, server, query)
+	event := TraceEvent{
+		Kind:     TraceQuery,
+		Question: query.Questions[0],
+		Zone:     zone,
+		Server:   server,
+		RTT:      time.Since(start),
+		Err:      err,
+	}
+	if err == nil {
+		event.RCode = rsp.Flags.ResponseCode()
+	}
+	traceEvent(ctx, event)
+	return rsp, err
+}
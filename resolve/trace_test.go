@@ -0,0 +1,128 @@
+package resolve_test
+
+import (
+	"context"
+	"dns"
+	"dns/resolve"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// describeTrace describes the events without their times, which vary.
+func describeTrace(events []resolve.TraceEvent) string {
+	var described []string
+	for _, e := range events {
+		var detail any
+		switch e.Kind {
+		case resolve.TraceQuery:
+			detail = e.Server
+		case resolve.TraceCacheHit:
+			detail = e.RCode
+		default:
+			detail = e.Target
+		}
+		described = append(described, fmt.Sprintf("%s %s/%s %s",
+			e.Kind, e.Question.Name, e.Question.Type, detail))
+	}
+	return strings.Join(described, "\n")
+}
+
+func TestResolveTrace(t *testing.T) {
+	n := testNet()
+	// example.com's server is only known by name:
+	n["10.0.1.1"] = zone(
+		rr("com.", dns.NS, "ns.com."),
+		rr("example.com.", dns.NS, "ns.example.net."),
+		rr("example.net.", dns.NS, "ns.com."),
+		rr("ns.example.net.", dns.A, "10.0.2.1"),
+	)
+	n["10.0.0.1"] = zone(
+		rr(".", dns.NS, "a.root."),
+		rr("a.root.", dns.A, "10.0.0.1"),
+		rr("com.", dns.NS, "ns.com."),
+		rr("net.", dns.NS, "ns.com."),
+		rr("ns.com.", dns.A, "10.0.1.1"),
+	)
+	r := newTestResolver(n)
+	r.QNAMEMinimisation = resolve.NoMinimisation
+	r.Family = resolve.IPv4Only
+	q := question("www.example.com", dns.A)
+
+	_, events, err := r.ResolveTrace(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"Query /NS 10.0.0.1",
+		"Query www.example.com/A 10.0.0.1",
+		"Referral www.example.com/A com",
+		"Query www.example.com/A 10.0.1.1",
+		"Referral www.example.com/A example.com",
+		"NSLookup www.example.com/A ns.example.net",
+		"Query ns.example.net/A 10.0.0.1",
+		"Referral ns.example.net/A net",
+		"Query ns.example.net/A 10.0.1.1",
+		"Query www.example.com/A 10.0.2.1",
+	}, "\n")
+	if got := describeTrace(events); got != want {
+		t.Errorf("expected trace:\n%s\ngot:\n%s", want, got)
+	}
+
+	_, events, err = r.ResolveTrace(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := describeTrace(events); got != "CacheHit www.example.com/A NoError" {
+		t.Errorf("expected a cache hit, got:\n%s", got)
+	}
+}
+
+func TestTraceStopsWhenResolveReturns(t *testing.T) {
+	n := testNet()
+	r := newTestResolver(n)
+	r.StaleAnswerTimeout = 10 * time.Millisecond
+	c, clock := newTestCache()
+	c.StaleWindow = time.Hour
+	r.Cache = c
+	q := question("www.example.com", dns.A)
+	if _, err := r.Resolve(context.Background(), q); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Hour + time.Second)
+	release := make(chan struct{})
+	n["10.0.2.1"] = gate(n["10.0.2.1"], release)
+	var returned, late atomic.Bool
+	ctx := resolve.WithTrace(context.Background(), func(e resolve.TraceEvent) {
+		if returned.Load() {
+			late.Store(true)
+		}
+	})
+	rsp, err := r.Resolve(ctx, q)
+	returned.Store(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasExtendedError(t, rsp, dns.StaleAnswer) {
+		t.Fatalf("expected a stale answer, got %v", rsp)
+	}
+
+	// the resolution carries on in the background, untraced:
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := c.Get(q); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the answer to be refreshed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if late.Load() {
+		t.Error("expected no steps to be traced after Resolve returned")
+	}
+}
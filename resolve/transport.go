@@ -0,0 +1,201 @@
+package resolve
+
+import (
+	"context"
+	"dns"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Transport sends a single query to a server and waits for the response.
+type Transport interface {
+	Exchange(ctx context.Context, server net.IP, query dns.Message) (dns.Message, error)
+}
+
+// ErrMismatchedResponse means that a response wasn't for the query that we
+// sent.
+var ErrMismatchedResponse = errors.New("response doesn't match query")
+
+// ErrServerFailed means that a server responded, but only to say that it
+// couldn't answer, so another server should be asked instead.
+var ErrServerFailed = errors.New("server failed")
+
+// serverFailed checks whether a response code means that the server
+// couldn't answer, rather than that the answer is that there's nothing
+// there.
+func serverFailed(rcode dns.ResponseCode) bool {
+	switch rcode {
+	case dns.ServerFailure, dns.Refused, dns.NotImplemented, dns.FormatError:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsTimeout checks whether a Transport failed because the server took too
+// long to respond.
+func IsTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// UDPTransport sends queries over UDP.
+type UDPTransport struct {
+	// Port is the port that servers listen on.  Defaults to 53.
+	Port int
+
+	// Timeout limits how long we wait for a response, in addition to any
+	// deadline on the context.  Defaults to 5 seconds.
+	Timeout time.Duration
+}
+
+func (t UDPTransport) Exchange(ctx context.Context, server net.IP, query dns.Message) (dns.Message, error) {
+	// idea for a test framework:
+	// - instrument this to capture each query/response and write it to json
+	// - replace this with a dummy that returns data from the json
+
+	buf, err := query.WriteTo(nil)
+	if err != nil {
+		return dns.Message{}, fmt.Errorf("couldn't serialize query: %s", err)
+	}
+
+	port := t.Port
+	if port == 0 {
+		port = 53
+	}
+	timeout := t.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp",
+		net.JoinHostPort(server.String(), strconv.Itoa(port)))
+	if err != nil {
+		return dns.Message{}, fmt.Errorf("couldn't dial server: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// unblock the read if we're cancelled before the deadline:
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	n, err := conn.Write(buf)
+	if err != nil {
+		return dns.Message{}, fmt.Errorf("unable to write udp message: %w", err)
+	} else if n < len(buf) {
+		return dns.Message{}, fmt.Errorf("wrote only %d bytes of %d byte message", n, len(buf))
+	}
+
+	rspBuf := make([]byte, 1024)
+	for {
+		n, err = conn.Read(rspBuf)
+		if err != nil {
+			return dns.Message{}, fmt.Errorf("couldn't read udp message: %w", err)
+		}
+		rsp, err := dns.ParseMessage(rspBuf[:n])
+		if err == nil && checkResponse(query, rsp) == nil {
+			return rsp, nil
+		}
+		// anyone can send us a packet from the server's address, so
+		// keep waiting for the real response until we time out
+	}
+}
+
+// TCPTransport sends queries over TCP, for responses that are too big for
+// UDP.  Each query uses a new connection.
+type TCPTransport struct {
+	// Port is the port that servers listen on.  Defaults to 53.
+	Port int
+
+	// Timeout limits how long we wait for a response, in addition to any
+	// deadline on the context.  Defaults to 5 seconds.
+	Timeout time.Duration
+}
+
+func (t TCPTransport) Exchange(ctx context.Context, server net.IP, query dns.Message) (dns.Message, error) {
+	msg, err := query.WriteTo(nil)
+	if err != nil {
+		return dns.Message{}, fmt.Errorf("couldn't serialize query: %s", err)
+	}
+	// messages are prefixed with their length over TCP:
+	buf := binary.BigEndian.AppendUint16(nil, uint16(len(msg)))
+	buf = append(buf, msg...)
+
+	port := t.Port
+	if port == 0 {
+		port = 53
+	}
+	timeout := t.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp",
+		net.JoinHostPort(server.String(), strconv.Itoa(port)))
+	if err != nil {
+		return dns.Message{}, fmt.Errorf("couldn't dial server: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	if _, err := conn.Write(buf); err != nil {
+		return dns.Message{}, fmt.Errorf("unable to write tcp message: %w", err)
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return dns.Message{}, fmt.Errorf("couldn't read tcp message: %w", err)
+	}
+	rspBuf := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, rspBuf); err != nil {
+		return dns.Message{}, fmt.Errorf("couldn't read tcp message: %w", err)
+	}
+	rsp, err := dns.ParseMessage(rspBuf)
+	if err != nil {
+		return dns.Message{}, err
+	}
+	return rsp, checkResponse(query, rsp)
+}
+
+// checkResponse checks that a response is for the query, with the same ID
+// and question, so that it isn't a forgery or meant for someone else.
+func checkResponse(query, rsp dns.Message) error {
+	if rsp.ID != query.ID {
+		return fmt.Errorf("%w: ID %d, expected %d", ErrMismatchedResponse, rsp.ID, query.ID)
+	}
+	if len(rsp.Questions) != len(query.Questions) {
+		return fmt.Errorf("%w: %d questions, expected %d",
+			ErrMismatchedResponse, len(rsp.Questions), len(query.Questions))
+	}
+	for i, q := range query.Questions {
+		got := rsp.Questions[i]
+		if !got.Name.Equal(q.Name) || got.Type != q.Type || got.Class != q.Class {
+			return fmt.Errorf("%w: question %s/%s, expected %s/%s",
+				ErrMismatchedResponse, got.Name, got.Type, q.Name, q.Type)
+		}
+	}
+	return nil
+}
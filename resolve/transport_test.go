@@ -0,0 +1,71 @@
+package resolve_test
+
+import (
+	"context"
+	"dns"
+	"dns/resolve"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPTransportTimesOut(t *testing.T) {
+	// a server that never answers:
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	transport := resolve.UDPTransport{
+		Port:    conn.LocalAddr().(*net.UDPAddr).Port,
+		Timeout: 10 * time.Millisecond,
+	}
+	query := dns.Message{Questions: []dns.Question{question("example.com", dns.A)}}
+	_, err = transport.Exchange(context.Background(), net.IPv4(127, 0, 0, 1), query)
+	if !resolve.IsTimeout(err) {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+}
+
+func TestUDPTransportIgnoresMismatchedResponses(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 512)
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		query, err := dns.ParseMessage(buf[:n])
+		if err != nil {
+			return
+		}
+		forged := dns.MakeResponse(query)
+		forged.ID++
+		forged.Answers = []dns.Resource{rr("example.com.", dns.A, "192.0.2.66")}
+		real := dns.MakeResponse(query)
+		real.Answers = []dns.Resource{rr("example.com.", dns.A, "192.0.2.1")}
+		for _, rsp := range []dns.Message{forged, real} {
+			if buf, err := rsp.WriteTo(nil); err == nil {
+				conn.WriteToUDP(buf, addr)
+			}
+		}
+	}()
+
+	transport := resolve.UDPTransport{
+		Port:    conn.LocalAddr().(*net.UDPAddr).Port,
+		Timeout: time.Second,
+	}
+	query := dns.Message{ID: 42, Questions: []dns.Question{question("example.com", dns.A)}}
+	rsp, err := transport.Exchange(context.Background(), net.IPv4(127, 0, 0, 1), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := describe(rsp.Answers); len(got) != 1 || got[0] != "example.com A 192.0.2.1" {
+		t.Errorf("expected the real answer, got %s", got)
+	}
+}